@@ -0,0 +1,116 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// crudHandlers serves the list, create, update and delete endpoints of a
+// persistent rule set. Each resource supplies only its store calls and the
+// defaults a new item starts from; validation happens in the proxy package.
+type crudHandlers[T any] struct {
+	// name is the singular resource name used in error messages.
+	name string
+	// defaults returns the value a create or update body is decoded onto.
+	// A PUT replaces the whole item, so omitted fields take the same
+	// defaults on update as on create.
+	defaults func() T
+	setID    func(*T, int64)
+	list     func() ([]*T, error)
+	create   func(*T) error
+	update   func(*T) error
+	delete   func(int64) error
+}
+
+// register adds the four endpoints under path and path/{id}.
+func (c *crudHandlers[T]) register(r *mux.Router, path string) {
+	r.HandleFunc(path, c.listItems).Methods("GET")
+	r.HandleFunc(path, c.createItem).Methods("POST")
+	r.HandleFunc(path+"/{id}", c.updateItem).Methods("PUT")
+	r.HandleFunc(path+"/{id}", c.deleteItem).Methods("DELETE")
+}
+
+func (c *crudHandlers[T]) listItems(w http.ResponseWriter, r *http.Request) {
+	items, err := c.list()
+	if err != nil {
+		http.Error(w, "Failed to load "+c.name+"s: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func (c *crudHandlers[T]) createItem(w http.ResponseWriter, r *http.Request) {
+	item := c.defaults()
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := c.create(&item); err != nil {
+		http.Error(w, "Failed to create "+c.name+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(item)
+}
+
+func (c *crudHandlers[T]) updateItem(w http.ResponseWriter, r *http.Request) {
+	id, ok := c.itemID(w, r)
+	if !ok {
+		return
+	}
+
+	item := c.defaults()
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.setID(&item, id)
+
+	if err := c.update(&item); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+func (c *crudHandlers[T]) deleteItem(w http.ResponseWriter, r *http.Request) {
+	id, ok := c.itemID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := c.delete(id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// itemID parses the {id} route variable, answering 400 when it is not a
+// number.
+func (c *crudHandlers[T]) itemID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid "+c.name+" ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"proxy-scanner/proxy"
+)
+
+func (h *APIHandler) faultRuleHandlers() *crudHandlers[proxy.FaultRule] {
+	return &crudHandlers[proxy.FaultRule]{
+		name:     "fault rule",
+		defaults: func() proxy.FaultRule { return proxy.FaultRule{Probability: 1, Enabled: true} },
+		setID:    func(rule *proxy.FaultRule, id int64) { rule.ID = id },
+		list:     h.store.GetFaultRules,
+		create:   h.proxyHandler.CreateFaultRule,
+		update:   h.proxyHandler.UpdateFaultRule,
+		delete:   h.proxyHandler.DeleteFaultRule,
+	}
+}
@@ -33,6 +33,15 @@ func (h *APIHandler) listRequests(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	requests, _ := h.store.GetAll()
+	if user := r.URL.Query().Get("user"); user != "" {
+		filtered := []*proxy.RequestData{}
+		for _, req := range requests {
+			if req.User == user {
+				filtered = append(filtered, req)
+			}
+		}
+		requests = filtered
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(requests)
@@ -75,3 +84,48 @@ func (h *APIHandler) repeatRequest(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Warning: error while copying response body: %v", err)
 	}
 }
+
+func (h *APIHandler) listWebSocketMessages(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		http.Error(w, "ID parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.store.GetWebSocketMessages(id)
+	if err != nil {
+		http.Error(w, "Failed to load messages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func (h *APIHandler) listRequestErrors(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		http.Error(w, "ID parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	errs, err := h.store.GetRequestErrors(id)
+	if err != nil {
+		http.Error(w, "Failed to load errors: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(errs)
+}
+
+func (h *APIHandler) hostLatency(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.store.GetHostLatency()
+	if err != nil {
+		http.Error(w, "Failed to load latency stats: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"proxy-scanner/proxy"
+)
+
+func (h *APIHandler) hostMappingHandlers() *crudHandlers[proxy.HostMapping] {
+	return &crudHandlers[proxy.HostMapping]{
+		name:     "host mapping",
+		defaults: func() proxy.HostMapping { return proxy.HostMapping{Enabled: true} },
+		setID:    func(mapping *proxy.HostMapping, id int64) { mapping.ID = id },
+		list:     h.store.GetHostMappings,
+		create:   h.proxyHandler.CreateHostMapping,
+		update:   h.proxyHandler.UpdateHostMapping,
+		delete:   h.proxyHandler.DeleteHostMapping,
+	}
+}
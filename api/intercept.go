@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"proxy-scanner/proxy"
+)
+
+func (h *APIHandler) getInterceptSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.proxyHandler.InterceptSettings())
+}
+
+func (h *APIHandler) updateInterceptSettings(w http.ResponseWriter, r *http.Request) {
+	var settings proxy.InterceptSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.proxyHandler.SetInterceptSettings(settings)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) listPendingIntercepts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.proxyHandler.PendingIntercepts())
+}
+
+func (h *APIHandler) forwardIntercept(w http.ResponseWriter, r *http.Request) {
+	var decision proxy.InterceptDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	decision.Drop = false
+
+	h.resolveIntercept(w, mux.Vars(r)["id"], decision)
+}
+
+func (h *APIHandler) dropIntercept(w http.ResponseWriter, r *http.Request) {
+	h.resolveIntercept(w, mux.Vars(r)["id"], proxy.InterceptDecision{Drop: true})
+}
+
+func (h *APIHandler) resolveIntercept(w http.ResponseWriter, id string, decision proxy.InterceptDecision) {
+	if err := h.proxyHandler.ResolveIntercept(id, decision); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
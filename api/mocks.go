@@ -0,0 +1,17 @@
+package api
+
+import (
+	"proxy-scanner/proxy"
+)
+
+func (h *APIHandler) mockRuleHandlers() *crudHandlers[proxy.MockRule] {
+	return &crudHandlers[proxy.MockRule]{
+		name:     "mock rule",
+		defaults: func() proxy.MockRule { return proxy.MockRule{Enabled: true} },
+		setID:    func(rule *proxy.MockRule, id int64) { rule.ID = id },
+		list:     h.store.GetMockRules,
+		create:   h.proxyHandler.CreateMockRule,
+		update:   h.proxyHandler.UpdateMockRule,
+		delete:   h.proxyHandler.DeleteMockRule,
+	}
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func (h *APIHandler) listPassthrough(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.proxyHandler.PassthroughHosts())
+}
+
+func (h *APIHandler) resetPassthrough(w http.ResponseWriter, r *http.Request) {
+	if err := h.proxyHandler.ResetPassthroughHost(mux.Vars(r)["host"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) listConnections(w http.ResponseWriter, r *http.Request) {
+	connections, err := h.store.GetConnections()
+	if err != nil {
+		http.Error(w, "Failed to load connections: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(connections)
+}
+
+func (h *APIHandler) getPoolStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.proxyHandler.PoolStats())
+}
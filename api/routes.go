@@ -9,8 +9,31 @@ func NewRouter(handler *APIHandler) *mux.Router {
 
 	r.HandleFunc("/requests", handler.listRequests).Methods("GET")
 	r.HandleFunc("/requests/{id}", handler.getRequest).Methods("GET")
+	r.HandleFunc("/requests/{id}/ws-messages", handler.listWebSocketMessages).Methods("GET")
+	r.HandleFunc("/requests/{id}/errors", handler.listRequestErrors).Methods("GET")
+	r.HandleFunc("/stats/latency", handler.hostLatency).Methods("GET")
 	r.HandleFunc("/repeat/{id}", handler.repeatRequest).Methods("GET")
 	r.HandleFunc("/scan/{id}", handler.checkRequestForXXE).Methods("GET")
 
+	r.HandleFunc("/intercept", handler.getInterceptSettings).Methods("GET")
+	r.HandleFunc("/intercept", handler.updateInterceptSettings).Methods("PUT")
+	r.HandleFunc("/intercept/pending", handler.listPendingIntercepts).Methods("GET")
+	r.HandleFunc("/intercept/pending/{id}/forward", handler.forwardIntercept).Methods("POST")
+	r.HandleFunc("/intercept/pending/{id}/drop", handler.dropIntercept).Methods("POST")
+
+	// /rules/order is registered first so that it is not taken for an ID.
+	r.HandleFunc("/rules/order", handler.reorderRules).Methods("PUT")
+	handler.matchRuleHandlers().register(r, "/rules")
+	handler.scopeRuleHandlers().register(r, "/scope")
+	handler.faultRuleHandlers().register(r, "/faults")
+	handler.mockRuleHandlers().register(r, "/mocks")
+	handler.scriptHandlers().register(r, "/scripts")
+	handler.hostMappingHandlers().register(r, "/hosts")
+
+	r.HandleFunc("/passthrough", handler.listPassthrough).Methods("GET")
+	r.HandleFunc("/passthrough/{host}", handler.resetPassthrough).Methods("DELETE")
+	r.HandleFunc("/connections", handler.listConnections).Methods("GET")
+	r.HandleFunc("/pool", handler.getPoolStats).Methods("GET")
+
 	return r
 }
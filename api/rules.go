@@ -0,0 +1,33 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"proxy-scanner/proxy"
+)
+
+func (h *APIHandler) matchRuleHandlers() *crudHandlers[proxy.MatchRule] {
+	return &crudHandlers[proxy.MatchRule]{
+		name:     "rule",
+		defaults: func() proxy.MatchRule { return proxy.MatchRule{Enabled: true} },
+		setID:    func(rule *proxy.MatchRule, id int64) { rule.ID = id },
+		list:     h.store.GetMatchRules,
+		create:   h.proxyHandler.CreateMatchRule,
+		update:   h.proxyHandler.UpdateMatchRule,
+		delete:   h.proxyHandler.DeleteMatchRule,
+	}
+}
+
+func (h *APIHandler) reorderRules(w http.ResponseWriter, r *http.Request) {
+	var ids []int64
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(w, "Expected a JSON array of rule IDs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.proxyHandler.ReorderMatchRules(ids); err != nil {
+		http.Error(w, "Failed to reorder rules: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
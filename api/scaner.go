@@ -62,11 +62,11 @@ func (h *APIHandler) scanForVulnerabilities(reqData *proxy.RequestData) []Vulner
 		}
 	}
 
-	for key, value := range reqData.BodyParams {
+	for _, value := range reqData.BodyParams {
 		if strings.Contains(strings.ToLower(value.Value), "<script>") {
 			vulnerabilities = append(vulnerabilities, Vulnerability{
 				Type:        "XSS",
-				Description: fmt.Sprintf("Possible XSS in form parameter '%s'", key),
+				Description: fmt.Sprintf("Possible XSS in form parameter '%s'", value.Key),
 				Severity:    "Medium",
 			})
 		}
@@ -75,7 +75,7 @@ func (h *APIHandler) scanForVulnerabilities(reqData *proxy.RequestData) []Vulner
 			if strings.Contains(strings.ToUpper(value.Value), strings.ToUpper(kw)) {
 				vulnerabilities = append(vulnerabilities, Vulnerability{
 					Type:        "SQL Injection",
-					Description: fmt.Sprintf("Possible SQL injection in form parameter '%s'", key),
+					Description: fmt.Sprintf("Possible SQL injection in form parameter '%s'", value.Key),
 					Severity:    "High",
 				})
 				break
@@ -114,9 +114,7 @@ func checkForXXE(req *http.Request) error {
 	return nil
 }
 
-func checkXXEVulnerability(req *http.Request) (bool, error) {
-	client := &http.Client{}
-
+func checkXXEVulnerability(client *http.Client, req *http.Request) (bool, error) {
 	if err := checkForXXE(req); err != nil {
 		return false, fmt.Errorf("failed to modify request for XXE: %v", err)
 	}
@@ -152,13 +150,19 @@ func (h *APIHandler) checkRequestForXXE(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	httpReq, err := http.NewRequest(req.Parsed.Method, req.Parsed.Scheme+"://"+req.Parsed.Host+req.Parsed.Path, bytes.NewReader(req.Parsed.RawBody))
+	targetURL := req.Parsed.Scheme + "://" + req.Parsed.Host + req.Parsed.Path
+	if !h.proxyHandler.InScope(targetURL) {
+		http.Error(w, "Target is out of scope", http.StatusForbidden)
+		return
+	}
+
+	httpReq, err := http.NewRequest(req.Parsed.Method, targetURL, bytes.NewReader(req.Parsed.RawBody))
 	if err != nil {
 		http.Error(w, "Failed to create HTTP request: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	isVulnerable, err := checkXXEVulnerability(httpReq)
+	isVulnerable, err := checkXXEVulnerability(&http.Client{Transport: h.proxyHandler.Transport()}, httpReq)
 	if err != nil {
 		http.Error(w, "Error checking for XXE vulnerability: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"proxy-scanner/proxy"
+)
+
+func (h *APIHandler) scopeRuleHandlers() *crudHandlers[proxy.ScopeRule] {
+	return &crudHandlers[proxy.ScopeRule]{
+		name:     "scope rule",
+		defaults: func() proxy.ScopeRule { return proxy.ScopeRule{Include: true, Enabled: true} },
+		setID:    func(rule *proxy.ScopeRule, id int64) { rule.ID = id },
+		list:     h.store.GetScopeRules,
+		create:   h.proxyHandler.CreateScopeRule,
+		update:   h.proxyHandler.UpdateScopeRule,
+		delete:   h.proxyHandler.DeleteScopeRule,
+	}
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"proxy-scanner/proxy"
+)
+
+func (h *APIHandler) scriptHandlers() *crudHandlers[proxy.Script] {
+	return &crudHandlers[proxy.Script]{
+		name:     "script",
+		defaults: func() proxy.Script { return proxy.Script{Enabled: true} },
+		setID:    func(script *proxy.Script, id int64) { script.ID = id },
+		list:     h.store.GetScripts,
+		create:   h.proxyHandler.CreateScript,
+		update:   h.proxyHandler.UpdateScript,
+		delete:   h.proxyHandler.DeleteScript,
+	}
+}
@@ -9,11 +9,176 @@ CREATE TABLE IF NOT EXISTS requests (
                                         cookies JSONB,
                                         post_params JSONB,
                                         raw_body BYTEA,
+                                        decoded_body BYTEA,
+                                        body_length BIGINT DEFAULT 0,
+                                        body_truncated BOOLEAN DEFAULT FALSE,
+                                        body_file TEXT,
                                         response_code INTEGER DEFAULT NULL,
                                         response_message TEXT,
                                         response_headers JSONB,
                                         response_body BYTEA,
+                                        response_raw_body BYTEA,
+                                        response_body_length BIGINT DEFAULT 0,
+                                        response_truncated BOOLEAN DEFAULT FALSE,
+                                        response_body_file TEXT,
+                                        timestamp TIMESTAMP,
+                                        conn_id TEXT,
+                                        proto TEXT,
+                                        applied_rules JSONB,
+                                        timing_dns_ms DOUBLE PRECISION,
+                                        timing_connect_ms DOUBLE PRECISION,
+                                        timing_tls_ms DOUBLE PRECISION,
+                                        timing_ttfb_ms DOUBLE PRECISION,
+                                        timing_total_ms DOUBLE PRECISION,
+                                        client_addr TEXT,
+                                        client_tls JSONB,
+                                        upstream_addr TEXT,
+                                        upstream_tls JSONB,
+                                        proxy_user TEXT,
+                                        fault JSONB,
+                                        mock_rule_id BIGINT
+);
+
+-- The schema is applied on every start; databases created by earlier
+-- versions get the columns added since then.
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS conn_id TEXT;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS proto TEXT;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS body_length BIGINT DEFAULT 0;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS body_truncated BOOLEAN DEFAULT FALSE;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS body_file TEXT;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS response_body_length BIGINT DEFAULT 0;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS response_truncated BOOLEAN DEFAULT FALSE;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS response_body_file TEXT;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS applied_rules JSONB;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS decoded_body BYTEA;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS response_raw_body BYTEA;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS timing_dns_ms DOUBLE PRECISION;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS timing_connect_ms DOUBLE PRECISION;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS timing_tls_ms DOUBLE PRECISION;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS timing_ttfb_ms DOUBLE PRECISION;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS timing_total_ms DOUBLE PRECISION;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS client_addr TEXT;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS client_tls JSONB;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS upstream_addr TEXT;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS upstream_tls JSONB;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS proxy_user TEXT;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS fault JSONB;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS mock_rule_id BIGINT;
+
+CREATE INDEX IF NOT EXISTS requests_timestamp_idx ON requests (timestamp);
+CREATE INDEX IF NOT EXISTS requests_conn_id_idx ON requests (conn_id);
+CREATE INDEX IF NOT EXISTS requests_host_idx ON requests (host);
+CREATE INDEX IF NOT EXISTS requests_proxy_user_idx ON requests (proxy_user);
+
+CREATE TABLE IF NOT EXISTS ws_messages (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        request_id TEXT REFERENCES requests (id) ON DELETE CASCADE,
+                                        direction TEXT,
+                                        opcode INTEGER,
+                                        payload BYTEA,
+                                        timestamp TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS ws_messages_request_id_idx ON ws_messages (request_id);
+
+
+CREATE TABLE IF NOT EXISTS match_rules (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        name TEXT NOT NULL DEFAULT '',
+                                        target TEXT NOT NULL,
+                                        match TEXT NOT NULL DEFAULT '',
+                                        replace TEXT NOT NULL DEFAULT '',
+                                        regex BOOLEAN NOT NULL DEFAULT FALSE,
+                                        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+                                        position INTEGER NOT NULL DEFAULT 0,
+                                        buffer_chunked BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+ALTER TABLE match_rules ADD COLUMN IF NOT EXISTS buffer_chunked BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS scope_rules (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        include BOOLEAN NOT NULL DEFAULT TRUE,
+                                        host TEXT NOT NULL DEFAULT '',
+                                        port INTEGER NOT NULL DEFAULT 0,
+                                        scheme TEXT NOT NULL DEFAULT '',
+                                        path_prefix TEXT NOT NULL DEFAULT '',
+                                        enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS fault_rules (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        name TEXT NOT NULL DEFAULT '',
+                                        host TEXT NOT NULL DEFAULT '',
+                                        path_prefix TEXT NOT NULL DEFAULT '',
+                                        probability DOUBLE PRECISION NOT NULL DEFAULT 1,
+                                        latency_ms INTEGER NOT NULL DEFAULT 0,
+                                        jitter_ms INTEGER NOT NULL DEFAULT 0,
+                                        bandwidth_bps INTEGER NOT NULL DEFAULT 0,
+                                        reset BOOLEAN NOT NULL DEFAULT FALSE,
+                                        status_code INTEGER NOT NULL DEFAULT 0,
+                                        truncate_bytes BIGINT NOT NULL DEFAULT 0,
+                                        enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS mock_rules (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        name TEXT NOT NULL DEFAULT '',
+                                        method TEXT NOT NULL DEFAULT '',
+                                        host TEXT NOT NULL DEFAULT '',
+                                        path TEXT NOT NULL DEFAULT '',
+                                        query TEXT NOT NULL DEFAULT '',
+                                        source TEXT NOT NULL,
+                                        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+                                        request_id TEXT NOT NULL DEFAULT '',
+                                        file_path TEXT NOT NULL DEFAULT '',
+                                        status_code INTEGER NOT NULL DEFAULT 0,
+                                        headers JSONB,
+                                        body TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS scripts (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        name TEXT NOT NULL DEFAULT '',
+                                        host TEXT NOT NULL DEFAULT '',
+                                        path_prefix TEXT NOT NULL DEFAULT '',
+                                        source TEXT NOT NULL,
+                                        timeout_ms INTEGER NOT NULL DEFAULT 0,
+                                        enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS host_mappings (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        host TEXT NOT NULL,
+                                        target TEXT NOT NULL,
+                                        enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS connections (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        conn_id TEXT,
+                                        kind TEXT NOT NULL,
+                                        target TEXT,
+                                        client_addr TEXT,
+                                        bytes_sent BIGINT DEFAULT 0,
+                                        bytes_received BIGINT DEFAULT 0,
+                                        started TIMESTAMP,
+                                        duration_ms BIGINT DEFAULT 0,
+                                        client_dump TEXT,
+                                        upstream_dump TEXT
+);
+
+ALTER TABLE connections ADD COLUMN IF NOT EXISTS client_dump TEXT;
+ALTER TABLE connections ADD COLUMN IF NOT EXISTS upstream_dump TEXT;
+
+CREATE INDEX IF NOT EXISTS connections_started_idx ON connections (started);
+
+CREATE TABLE IF NOT EXISTS request_errors (
+                                        id BIGSERIAL PRIMARY KEY,
+                                        request_id TEXT REFERENCES requests (id) ON DELETE CASCADE,
+                                        kind TEXT NOT NULL,
+                                        message TEXT,
                                         timestamp TIMESTAMP
 );
 
-CREATE INDEX IF NOT EXISTS requests_timestamp_idx ON requests (timestamp);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS request_errors_request_id_idx ON request_errors (request_id);
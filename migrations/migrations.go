@@ -0,0 +1,10 @@
+// Package migrations holds the database schema.
+package migrations
+
+import _ "embed"
+
+// Schema creates every table and index and adds columns introduced since
+// the first release. It is safe to run against an existing database.
+//
+//go:embed init.sql
+var Schema string
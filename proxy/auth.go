@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const proxyAuthRealm = "proxy-scanner"
+
+// tokenUser is recorded as the user of requests authenticated with the
+// static token.
+const tokenUser = "token"
+
+// AuthConfig enables Proxy-Authorization on the HTTP proxy listener and
+// username/password login on the SOCKS5 listener. The transparent listener
+// has no way to authenticate clients and refuses to start while auth is on.
+// Auth is off when both fields are empty.
+type AuthConfig struct {
+	// UsersFile lists "user:password" lines for Basic credentials. Empty
+	// lines and lines starting with "#" are ignored.
+	UsersFile string
+	// Token is accepted as "Bearer <token>", or as the password of Basic
+	// credentials with any user name. Either way the user is recorded as
+	// "token".
+	Token string
+}
+
+type proxyAuth struct {
+	users map[string]string
+	token string
+}
+
+func newProxyAuth(cfg AuthConfig) (*proxyAuth, error) {
+	if cfg.UsersFile == "" && cfg.Token == "" {
+		return nil, nil
+	}
+
+	a := &proxyAuth{users: make(map[string]string), token: cfg.Token}
+	if cfg.UsersFile == "" {
+		return a, nil
+	}
+
+	f, err := os.Open(cfg.UsersFile)
+	if err != nil {
+		return nil, fmt.Errorf("proxy users: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("proxy users: %s:%d: expected user:password", cfg.UsersFile, n)
+		}
+		a.users[user] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("proxy users: %v", err)
+	}
+	return a, nil
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticate checks the Proxy-Authorization header and returns the user
+// it belongs to.
+func (a *proxyAuth) authenticate(header string) (string, bool) {
+	scheme, credentials, _ := strings.Cut(header, " ")
+	credentials = strings.TrimSpace(credentials)
+
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		if a.token != "" && secureEqual(credentials, a.token) {
+			return tokenUser, true
+		}
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", false
+		}
+		user, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", false
+		}
+		return a.check(user, password)
+	}
+	return "", false
+}
+
+// check verifies a user name and password. The static token is accepted as
+// the password of any user name but is always recorded as tokenUser.
+func (a *proxyAuth) check(user, password string) (string, bool) {
+	if want, exists := a.users[user]; exists && secureEqual(password, want) {
+		return user, true
+	}
+	if a.token != "" && secureEqual(password, a.token) {
+		return tokenUser, true
+	}
+	return "", false
+}
+
+// checkProxyAuth authenticates r and answers with a 407 challenge when
+// credentials are missing or wrong. ok is false when the request has been
+// answered.
+func (p *ProxyHandler) checkProxyAuth(w http.ResponseWriter, r *http.Request) (user string, ok bool) {
+	if p.auth == nil {
+		return "", true
+	}
+
+	user, ok = p.auth.authenticate(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return "", false
+	}
+	return user, true
+}
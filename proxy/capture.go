@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// capturedBody is the recorded part of a message body.
+type capturedBody struct {
+	// Data holds the bytes as sent on the wire, Decoded the same body with
+	// its Content-Encoding removed, or nil when it was not encoded.
+	Data      []byte
+	Decoded   []byte
+	Length    int64
+	Truncated bool
+	File      string
+}
+
+// teeCapture passes a body through to its consumer unchanged while recording
+// it. Up to MaxBodySize bytes are kept in memory; once a body grows past the
+// limit it is written to a spool file instead. onDone is called exactly once
+// when the body has been read to the end or closed.
+type teeCapture struct {
+	rc        io.ReadCloser
+	cfg       CaptureConfig
+	spoolName string
+	onDone    func(capturedBody)
+
+	buf       bytes.Buffer
+	length    int64
+	truncated bool
+	spool     *os.File
+	once      sync.Once
+}
+
+func newTeeCapture(rc io.ReadCloser, cfg CaptureConfig, spoolName string, onDone func(capturedBody)) *teeCapture {
+	return &teeCapture{
+		rc:        rc,
+		cfg:       cfg,
+		spoolName: spoolName,
+		onDone:    onDone,
+	}
+}
+
+func (c *teeCapture) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	if n > 0 {
+		c.record(p[:n])
+	}
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *teeCapture) Close() error {
+	err := c.rc.Close()
+	c.finish()
+	return err
+}
+
+func (c *teeCapture) record(b []byte) {
+	c.length += int64(len(b))
+
+	if c.spool != nil {
+		c.writeSpool(b)
+		return
+	}
+	if c.truncated {
+		return
+	}
+
+	if c.cfg.MaxBodySize > 0 {
+		if room := c.cfg.MaxBodySize - int64(c.buf.Len()); int64(len(b)) > room {
+			c.truncated = true
+			c.startSpool()
+			if c.spool != nil {
+				c.writeSpool(b)
+			}
+			c.buf.Write(b[:room])
+			return
+		}
+	}
+	c.buf.Write(b)
+}
+
+func (c *teeCapture) startSpool() {
+	if c.cfg.SpoolDir == "" {
+		return
+	}
+
+	f, err := os.Create(filepath.Join(c.cfg.SpoolDir, c.spoolName))
+	if err != nil {
+		log.Printf("Failed to create spool file %s: %v", c.spoolName, err)
+		return
+	}
+	c.spool = f
+	c.writeSpool(c.buf.Bytes())
+}
+
+func (c *teeCapture) writeSpool(b []byte) {
+	if _, err := c.spool.Write(b); err != nil {
+		log.Printf("Failed to write spool file %s: %v", c.spool.Name(), err)
+		c.spool.Close()
+		os.Remove(c.spool.Name())
+		c.spool = nil
+		c.cfg.SpoolDir = ""
+	}
+}
+
+func (c *teeCapture) finish() {
+	c.once.Do(func() {
+		body := capturedBody{
+			Data:      c.buf.Bytes(),
+			Length:    c.length,
+			Truncated: c.truncated,
+		}
+		if c.spool != nil {
+			body.File = c.spool.Name()
+			if err := c.spool.Close(); err != nil {
+				log.Printf("Failed to close spool file %s: %v", body.File, err)
+			}
+		}
+		c.onDone(body)
+	})
+}
+
+// captureBody replaces *body with a recording reader. Empty bodies are left
+// alone and never reported.
+func captureBody(body *io.ReadCloser, cfg CaptureConfig, spoolName string, onDone func(capturedBody)) {
+	if *body == nil || *body == http.NoBody {
+		return
+	}
+	*body = newTeeCapture(*body, cfg, spoolName, onDone)
+}
+
+func spoolFileName(id, part string) string {
+	return fmt.Sprintf("%s.%s", id, part)
+}
+
+// copyAndFlush streams src to w, flushing after every write so that
+// streaming responses reach the client without delay.
+func copyAndFlush(w http.ResponseWriter, src io.Reader) error {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *DBStore) UpdateRequestBody(id string, body capturedBody, postParams map[string]string) error {
+	params, err := toJSONB(postParams)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+        UPDATE requests SET
+            raw_body = $1,
+            decoded_body = $2,
+            post_params = $3,
+            body_length = $4,
+            body_truncated = $5,
+            body_file = $6
+        WHERE id = $7
+    `,
+		body.Data,
+		body.Decoded,
+		params,
+		body.Length,
+		body.Truncated,
+		body.File,
+		id,
+	)
+	return err
+}
+
+// UpdateResponseBody stores the decoded response body for analysis and keeps
+// the encoded bytes in response_raw_body for faithful exports.
+func (s *DBStore) UpdateResponseBody(id string, body capturedBody) error {
+	var raw []byte
+	if body.Decoded != nil {
+		raw = body.Data
+	}
+
+	_, err := s.db.Exec(`
+        UPDATE requests SET
+            response_body = $1,
+            response_raw_body = $2,
+            response_body_length = $3,
+            response_truncated = $4,
+            response_body_file = $5
+        WHERE id = $6
+    `,
+		body.analysisData(),
+		raw,
+		body.Length,
+		body.Truncated,
+		body.File,
+		id,
+	)
+	return err
+}
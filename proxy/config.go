@@ -0,0 +1,44 @@
+package proxy
+
+// Config holds the runtime settings of a ProxyHandler.
+type Config struct {
+	Capture     CaptureConfig
+	Upstream    UpstreamConfig
+	UpstreamTLS UpstreamTLSConfig
+	Transport   TransportConfig
+	Auth        AuthConfig
+	Passthrough PassthroughConfig
+	Reverse     ReverseConfig
+	Mocks       MockConfig
+	Tunnel      TunnelConfig
+	// Interceptors are Go hooks run on every flow, in order.
+	Interceptors []Interceptor
+}
+
+// CaptureConfig controls how much of each message body is recorded.
+type CaptureConfig struct {
+	// MaxBodySize is the number of body bytes kept in the database. Zero
+	// disables the limit.
+	MaxBodySize int64
+	// SpoolDir receives bodies larger than MaxBodySize in full. Empty
+	// disables spooling.
+	SpoolDir string
+	// TCPDumpSize is the number of bytes per direction kept as a hexdump
+	// for tunnels relayed as raw TCP. Zero disables the dump.
+	TCPDumpSize int
+}
+
+// MockConfig controls mocked responses.
+type MockConfig struct {
+	// Dir holds the files served by file mocks, whose FilePath is relative
+	// to it. Empty disables file mocks.
+	Dir string
+}
+
+// TunnelConfig controls tunnels that carry neither TLS nor HTTP.
+type TunnelConfig struct {
+	// RawPorts are target ports of server-first protocols such as SMTP or
+	// MySQL. A tunnel to one of them whose client stays silent is relayed
+	// as raw TCP; tunnels to other ports keep waiting for the client.
+	RawPorts []int
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// connInfo describes the client connection a request arrived on. It travels
+// with the request context so that saveRequest can tag every flow with it.
+type connInfo struct {
+	ID         string
+	ClientAddr string
+	User       string
+	// TLS is the client leg as negotiated by the MITM, nil for plain HTTP.
+	TLS *TLSInfo
+
+	// conn is the tracked client connection of a tunnel, closed early on
+	// shutdown while it is idle.
+	conn net.Conn
+}
+
+type connInfoKey struct{}
+
+var connCounter uint64
+
+func newConnInfo() *connInfo {
+	return &connInfo{
+		ID: fmt.Sprintf("c%d-%d", time.Now().UnixNano(), atomic.AddUint64(&connCounter, 1)),
+	}
+}
+
+func withConnInfo(ctx context.Context, ci *connInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, ci)
+}
+
+func connInfoFrom(ctx context.Context) *connInfo {
+	if ci, ok := ctx.Value(connInfoKey{}).(*connInfo); ok {
+		return ci
+	}
+	return &connInfo{}
+}
+
+// flowInfo collects what the pipeline did to a single request so that it
+// can be stored alongside it.
+type flowInfo struct {
+	AppliedRules []int64
+	UpstreamAddr string
+	Fault        *InjectedFault
+	MockRuleID   int64
+	// ScriptErrors are script failures not stored yet.
+	ScriptErrors []string
+}
+
+type flowInfoKey struct{}
+
+func withFlowInfo(ctx context.Context, fi *flowInfo) context.Context {
+	return context.WithValue(ctx, flowInfoKey{}, fi)
+}
+
+func flowInfoFrom(ctx context.Context) *flowInfo {
+	if fi, ok := ctx.Value(flowInfoKey{}).(*flowInfo); ok {
+		return fi
+	}
+	return &flowInfo{}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+)
+
+// TLSInfo describes one TLS leg of a flow.
+type TLSInfo struct {
+	SNI     string `json:"sni,omitempty"`
+	Version string `json:"version"`
+	Cipher  string `json:"cipher"`
+	ALPN    string `json:"alpn,omitempty"`
+}
+
+func tlsInfoFromState(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	return &TLSInfo{
+		SNI:     state.ServerName,
+		Version: tls.VersionName(state.Version),
+		Cipher:  tls.CipherSuiteName(state.CipherSuite),
+		ALPN:    state.NegotiatedProtocol,
+	}
+}
+
+// tlsInfoJSON encodes info for a nullable JSONB column.
+func tlsInfoJSON(info *TLSInfo) ([]byte, error) {
+	if info == nil {
+		return nil, nil
+	}
+	return json.Marshal(info)
+}
+
+func tlsInfoFromJSON(data []byte) *TLSInfo {
+	if len(data) == 0 {
+		return nil
+	}
+	var info TLSInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil
+	}
+	return &info
+}
+
+// saveUpstreamConn records which address was dialed for a request and how
+// the upstream leg was protected.
+func (p *ProxyHandler) saveUpstreamConn(id, addr string, state *tls.ConnectionState) {
+	if err := p.store.UpdateUpstreamConn(id, addr, tlsInfoFromState(state)); err != nil {
+		log.Printf("Failed to save upstream connection for %s: %v", id, err)
+	}
+}
+
+func (s *DBStore) UpdateUpstreamConn(id, addr string, info *TLSInfo) error {
+	upstreamTLS, err := tlsInfoJSON(info)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+        UPDATE requests SET
+            upstream_addr = $1,
+            upstream_tls = $2
+        WHERE id = $3
+    `,
+		addr,
+		upstreamTLS,
+		id,
+	)
+	return err
+}
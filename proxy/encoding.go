@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// errDecodedTooLarge is returned by decodeBody when the decoded body would
+// exceed the capture limit.
+var errDecodedTooLarge = errors.New("decoded body exceeds the capture limit")
+
+// decodeBody undoes the Content-Encoding of a captured body for storage and
+// analysis. Stacked encodings such as "deflate, gzip" are removed in reverse
+// order of application. It returns nil without an error for identity
+// encoded bodies. limit caps the decoded size; zero means no limit.
+func decodeBody(body []byte, encoding string, limit int64) ([]byte, error) {
+	var codings []string
+	for _, c := range strings.Split(encoding, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != "" && c != "identity" {
+			codings = append(codings, c)
+		}
+	}
+	if len(codings) == 0 {
+		return nil, nil
+	}
+
+	data := body
+	for i := len(codings) - 1; i >= 0; i-- {
+		r, err := newDecoder(codings[i], bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", codings[i], err)
+		}
+		data, err = readLimited(r, limit)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", codings[i], err)
+		}
+	}
+	return data, nil
+}
+
+func newDecoder(coding string, r *bytes.Reader) (io.ReadCloser, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Servers disagree whether deflate means zlib-wrapped or raw
+		// DEFLATE, so fall back to raw when the zlib header is missing.
+		zr, err := zlib.NewReader(r)
+		if err == nil {
+			return zr, nil
+		}
+		r.Seek(0, io.SeekStart)
+		return flate.NewReader(r), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding")
+	}
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errDecodedTooLarge
+	}
+	return data, nil
+}
+
+// decode fills in Decoded for a body captured in full. Bodies that cannot be
+// decoded are kept as they are.
+func (b *capturedBody) decode(encoding string, limit int64) {
+	if b.Truncated || encoding == "" || len(b.Data) == 0 {
+		return
+	}
+	decoded, err := decodeBody(b.Data, encoding, limit)
+	if err != nil {
+		log.Printf("Keeping %q encoded body as is: %v", encoding, err)
+		return
+	}
+	b.Decoded = decoded
+}
+
+// analysisData returns the decoded body if there is one, else the raw bytes.
+func (b capturedBody) analysisData() []byte {
+	if b.Decoded != nil {
+		return b.Decoded
+	}
+	return b.Data
+}
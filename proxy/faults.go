@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errFaultReset makes the caller drop the client connection.
+	errFaultReset = errors.New("connection reset by fault rule")
+	// errFaultTruncated ends a response body early.
+	errFaultTruncated = errors.New("body truncated by fault rule")
+)
+
+// FaultRule degrades matching traffic to simulate a bad network. Every
+// request matching Host and PathPrefix triggers the rule with the given
+// Probability; the first triggered rule applies all of its non-zero
+// effects.
+type FaultRule struct {
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"`
+	Host        string  `json:"host"`
+	PathPrefix  string  `json:"path_prefix"`
+	Probability float64 `json:"probability"`
+	// LatencyMs delays the request, plus a random extra of up to JitterMs.
+	LatencyMs int `json:"latency_ms"`
+	JitterMs  int `json:"jitter_ms"`
+	// BandwidthBps throttles the response body to this many bytes per second.
+	BandwidthBps int `json:"bandwidth_bps"`
+	// Reset drops the client connection instead of answering.
+	Reset bool `json:"reset"`
+	// StatusCode answers with this status without contacting the upstream.
+	StatusCode int `json:"status_code"`
+	// TruncateBytes cuts the response body after this many bytes.
+	TruncateBytes int64 `json:"truncate_bytes"`
+	Enabled       bool  `json:"enabled"`
+}
+
+func (r *FaultRule) validate() error {
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("probability must be between 0 and 1")
+	}
+	if r.LatencyMs < 0 || r.JitterMs < 0 || r.BandwidthBps < 0 || r.TruncateBytes < 0 {
+		return fmt.Errorf("fault values must not be negative")
+	}
+	if r.StatusCode != 0 && (r.StatusCode < 100 || r.StatusCode > 999) {
+		return fmt.Errorf("invalid status code %d", r.StatusCode)
+	}
+	return nil
+}
+
+func (r *FaultRule) matches(req *http.Request) bool {
+	if r.Host != "" && !matchHost(r.Host, req.URL.Host) {
+		return false
+	}
+	return r.PathPrefix == "" || strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// InjectedFault records which fault rule hit a request and what it did.
+type InjectedFault struct {
+	RuleID  int64    `json:"rule_id"`
+	Effects []string `json:"effects"`
+}
+
+// faultPlan is what a triggered rule does to one request.
+type faultPlan struct {
+	rule  *FaultRule
+	delay time.Duration
+}
+
+func (f *faultPlan) record() *InjectedFault {
+	r := f.rule
+	inj := &InjectedFault{RuleID: r.ID}
+	if f.delay > 0 {
+		inj.Effects = append(inj.Effects, fmt.Sprintf("latency=%s", f.delay))
+	}
+	if r.Reset {
+		inj.Effects = append(inj.Effects, "reset")
+	}
+	if r.StatusCode != 0 {
+		inj.Effects = append(inj.Effects, fmt.Sprintf("status=%d", r.StatusCode))
+	}
+	if r.BandwidthBps > 0 {
+		inj.Effects = append(inj.Effects, fmt.Sprintf("bandwidth=%dB/s", r.BandwidthBps))
+	}
+	if r.TruncateBytes > 0 {
+		inj.Effects = append(inj.Effects, fmt.Sprintf("truncate=%d", r.TruncateBytes))
+	}
+	return inj
+}
+
+type faultSet struct {
+	mu    sync.RWMutex
+	rules []*FaultRule
+}
+
+func (s *faultSet) set(rules []*FaultRule) {
+	var enabled []*FaultRule
+	for _, r := range rules {
+		if r.Enabled {
+			enabled = append(enabled, r)
+		}
+	}
+
+	s.mu.Lock()
+	s.rules = enabled
+	s.mu.Unlock()
+}
+
+// plan rolls the dice for req and returns nil when no rule triggers.
+func (s *faultSet) plan(req *http.Request) *faultPlan {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.rules {
+		if !r.matches(req) || rand.Float64() >= r.Probability {
+			continue
+		}
+		delay := time.Duration(r.LatencyMs) * time.Millisecond
+		if r.JitterMs > 0 {
+			delay += time.Duration(rand.IntN(r.JitterMs+1)) * time.Millisecond
+		}
+		return &faultPlan{rule: r, delay: delay}
+	}
+	return nil
+}
+
+// send applies the plan around sending req with send.
+func (f *faultPlan) send(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if f == nil {
+		return send(req)
+	}
+	r := f.rule
+
+	if f.delay > 0 {
+		if err := sleepContext(req.Context(), f.delay); err != nil {
+			return nil, err
+		}
+	}
+	if r.Reset {
+		return nil, errFaultReset
+	}
+
+	var resp *http.Response
+	if r.StatusCode != 0 {
+		resp = &http.Response{
+			Status:     fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+			StatusCode: r.StatusCode,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Length": {"0"}},
+			Body:       http.NoBody,
+			Request:    req,
+		}
+	} else {
+		var err error
+		if resp, err = send(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.Body != nil && resp.Body != http.NoBody && resp.StatusCode != http.StatusSwitchingProtocols {
+		if r.TruncateBytes > 0 {
+			resp.Body = &truncatedBody{rc: resp.Body, remaining: r.TruncateBytes}
+		}
+		if r.BandwidthBps > 0 {
+			resp.Body = &throttledBody{rc: resp.Body, bps: r.BandwidthBps, ctx: req.Context()}
+		}
+	}
+	return resp, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledBody delivers a body at roughly bps bytes per second. Its pauses
+// end early when ctx, the request context, is done.
+type throttledBody struct {
+	rc  io.ReadCloser
+	bps int
+	ctx context.Context
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	// Read in chunks of about a tenth of a second to keep delivery smooth.
+	chunk := b.bps / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := b.rc.Read(p)
+	if n > 0 {
+		if serr := sleepContext(b.ctx, time.Duration(n)*time.Second/time.Duration(b.bps)); serr != nil {
+			return n, serr
+		}
+	}
+	return n, err
+}
+
+func (b *throttledBody) Close() error {
+	return b.rc.Close()
+}
+
+// truncatedBody fails with errFaultTruncated after remaining bytes.
+type truncatedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, errFaultTruncated
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.rc.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.rc.Close()
+}
+
+func (p *ProxyHandler) ReloadFaultRules() error {
+	rules, err := p.store.GetFaultRules()
+	if err != nil {
+		return err
+	}
+	p.faults.set(rules)
+	return nil
+}
+
+func (p *ProxyHandler) CreateFaultRule(rule *FaultRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.CreateFaultRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadFaultRules()
+}
+
+func (p *ProxyHandler) UpdateFaultRule(rule *FaultRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.UpdateFaultRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadFaultRules()
+}
+
+func (p *ProxyHandler) DeleteFaultRule(id int64) error {
+	if err := p.store.DeleteFaultRule(id); err != nil {
+		return err
+	}
+	return p.ReloadFaultRules()
+}
+
+func (s *DBStore) GetFaultRules() ([]*FaultRule, error) {
+	rows, err := s.db.Query(`
+        SELECT id, name, host, path_prefix, probability, latency_ms, jitter_ms,
+               bandwidth_bps, reset, status_code, truncate_bytes, enabled
+        FROM fault_rules
+        ORDER BY id
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fault rules: %v", err)
+	}
+	defer rows.Close()
+
+	rules := []*FaultRule{}
+	for rows.Next() {
+		var r FaultRule
+		if err := rows.Scan(
+			&r.ID,
+			&r.Name,
+			&r.Host,
+			&r.PathPrefix,
+			&r.Probability,
+			&r.LatencyMs,
+			&r.JitterMs,
+			&r.BandwidthBps,
+			&r.Reset,
+			&r.StatusCode,
+			&r.TruncateBytes,
+			&r.Enabled,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan fault rule row: %v", err)
+		}
+		rules = append(rules, &r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return rules, nil
+}
+
+func (s *DBStore) CreateFaultRule(r *FaultRule) error {
+	return s.db.QueryRow(`
+        INSERT INTO fault_rules (
+            name, host, path_prefix, probability, latency_ms, jitter_ms,
+            bandwidth_bps, reset, status_code, truncate_bytes, enabled
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        RETURNING id
+    `, r.Name, r.Host, r.PathPrefix, r.Probability, r.LatencyMs, r.JitterMs,
+		r.BandwidthBps, r.Reset, r.StatusCode, r.TruncateBytes, r.Enabled).Scan(&r.ID)
+}
+
+func (s *DBStore) UpdateFaultRule(r *FaultRule) error {
+	res, err := s.db.Exec(`
+        UPDATE fault_rules SET
+            name = $1, host = $2, path_prefix = $3, probability = $4,
+            latency_ms = $5, jitter_ms = $6, bandwidth_bps = $7, reset = $8,
+            status_code = $9, truncate_bytes = $10, enabled = $11
+        WHERE id = $12
+    `, r.Name, r.Host, r.PathPrefix, r.Probability, r.LatencyMs, r.JitterMs,
+		r.BandwidthBps, r.Reset, r.StatusCode, r.TruncateBytes, r.Enabled, r.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *DBStore) DeleteFaultRule(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM fault_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func faultJSON(f *InjectedFault) ([]byte, error) {
+	if f == nil {
+		return nil, nil
+	}
+	return json.Marshal(f)
+}
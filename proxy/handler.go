@@ -2,62 +2,182 @@ package proxy
 
 import (
 	"bytes"
-	"compress/gzip"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
 	"strings"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 type ProxyHandler struct {
-	store       *DBStore
-	certManager *CertManager
+	store        *DBStore
+	certManager  *CertManager
+	cfg          Config
+	upstream     *upstreamRouter
+	transport    *upstreamTransport
+	intercept    *interceptQueue
+	rules        *ruleSet
+	scope        *scope
+	passthrough  *passthroughList
+	auth         *proxyAuth
+	hosts        *hostMap
+	faults       *faultSet
+	mocks        *mockSet
+	reverse      *reverseRouter
+	conns        *connTracker
+	h2           *http2.Server
+	h2Base       *http.Server
+	interceptors interceptorChain
+	scripts      *scriptSet
 }
 
-func NewProxyHandler(store *DBStore, certManager *CertManager) *ProxyHandler {
-	return &ProxyHandler{
-		store:       store,
-		certManager: certManager,
+func NewProxyHandler(store *DBStore, certManager *CertManager, cfg Config) (*ProxyHandler, error) {
+	if cfg.Capture.SpoolDir != "" {
+		if err := os.MkdirAll(cfg.Capture.SpoolDir, 0700); err != nil {
+			log.Printf("Spooling disabled, cannot create %s: %v", cfg.Capture.SpoolDir, err)
+			cfg.Capture.SpoolDir = ""
+		}
+	}
+
+	hosts := &hostMap{}
+	upstream, err := newUpstreamRouter(cfg.Upstream, newHostDialer(cfg.Transport, hosts))
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newUpstreamTransport(cfg, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newProxyAuth(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	reverse, err := newReverseRouter(cfg.Reverse)
+	if err != nil {
+		return nil, err
+	}
+
+	h2, h2Base, err := newMITMHTTP2Server()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ProxyHandler{
+		store:        store,
+		certManager:  certManager,
+		cfg:          cfg,
+		upstream:     upstream,
+		transport:    transport,
+		intercept:    newInterceptQueue(),
+		rules:        &ruleSet{},
+		scope:        &scope{},
+		passthrough:  newPassthroughList(cfg.Passthrough),
+		auth:         auth,
+		hosts:        hosts,
+		faults:       &faultSet{},
+		mocks:        &mockSet{},
+		reverse:      reverse,
+		conns:        newConnTracker(),
+		h2:           h2,
+		h2Base:       h2Base,
+		interceptors: cfg.Interceptors,
+		scripts:      &scriptSet{},
+	}
+
+	p.conns.addServer(h2Base)
+
+	if err := p.ReloadRules(); err != nil {
+		return nil, err
+	}
+	if err := p.ReloadScope(); err != nil {
+		return nil, err
+	}
+	if err := p.ReloadHostMappings(); err != nil {
+		return nil, err
 	}
+	if err := p.ReloadFaultRules(); err != nil {
+		return nil, err
+	}
+	if err := p.ReloadMockRules(); err != nil {
+		return nil, err
+	}
+	if err := p.ReloadScripts(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
 }
 
 func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodConnect {
-		p.handleHTTPS(w, r)
+	p.conns.begin()
+	defer p.conns.end()
+
+	user, ok := p.checkProxyAuth(w, r)
+	if !ok {
 		return
 	}
-	reqData, err := p.saveRequest(r)
-	if err != nil {
-		http.Error(w, "Error saving request", http.StatusInternalServerError)
+	if r.Method == http.MethodConnect {
+		p.handleHTTPS(w, r, user)
 		return
 	}
+	if isWebSocketUpgrade(r) {
+		prepareWebSocketRequest(r)
+	}
 
+	r = r.WithContext(withConnInfo(r.Context(), &connInfo{ClientAddr: r.RemoteAddr, User: user}))
 	modifiedReq, err := p.modifyRequest(r)
 	if err != nil {
 		http.Error(w, "Error modifying request", http.StatusBadRequest)
 		return
 	}
 
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-		Timeout: 30 * time.Second,
+	reqData, resp, err := p.forward(modifiedReq, p.transport.RoundTrip)
+	if errors.Is(err, errFaultReset) {
+		panic(http.ErrAbortHandler)
 	}
-
-	resp, err := client.Do(modifiedReq)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusBadGateway)
 		return
 	}
+	p.writeResponse(w, resp, reqData)
+}
+
+// writeResponse sends a forwarded response to the client, taking over the
+// connection when the protocol is upgraded.
+func (p *ProxyHandler) writeResponse(w http.ResponseWriter, resp *http.Response, reqData *RequestData) {
 	defer resp.Body.Close()
 
-	p.saveResponse(reqData.ID, resp)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+		clientConn, brw, err := hijacker.Hijack()
+		if err != nil {
+			log.Printf("Failed to hijack upgraded connection: %v", err)
+			return
+		}
+		defer clientConn.Close()
+		if !p.conns.add(clientConn) {
+			return
+		}
+		defer p.conns.remove(clientConn)
+		p.relayUpgrade(clientConn, brw.Reader, resp, reqData)
+		return
+	}
 
 	for k, vv := range resp.Header {
 		for _, v := range vv {
@@ -66,7 +186,9 @@ func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	io.Copy(w, resp.Body)
+	if err := copyAndFlush(w, resp.Body); errors.Is(err, errFaultTruncated) {
+		panic(http.ErrAbortHandler)
+	}
 }
 
 func (p *ProxyHandler) modifyRequest(r *http.Request) (*http.Request, error) {
@@ -80,13 +202,13 @@ func (p *ProxyHandler) modifyRequest(r *http.Request) (*http.Request, error) {
 		return nil, err
 	}
 
-	newReq, err := http.NewRequest(r.Method, parsedURL.String(), r.Body)
+	newReq, err := http.NewRequestWithContext(r.Context(), r.Method, parsedURL.String(), r.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	for k, vv := range r.Header {
-		if strings.ToLower(k) == "proxy-connection" {
+		if k := strings.ToLower(k); k == "proxy-connection" || k == "proxy-authorization" {
 			continue
 		}
 		for _, v := range vv {
@@ -98,17 +220,132 @@ func (p *ProxyHandler) modifyRequest(r *http.Request) (*http.Request, error) {
 	newReq.TransferEncoding = r.TransferEncoding
 	newReq.Close = r.Close
 	newReq.Host = r.Host
+	newReq.Proto, newReq.ProtoMajor, newReq.ProtoMinor = r.Proto, r.ProtoMajor, r.ProtoMinor
 	fmt.Printf("Modified request: %s %s HTTP/1.1\n", newReq.Method, newReq.URL.Path)
 	return newReq, nil
 }
 
-func (p *ProxyHandler) saveRequest(r *http.Request) (*RequestData, error) {
-	var bodyBytes []byte
-	if r.Body != nil {
-		bodyBytes, _ = io.ReadAll(r.Body)
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+// ErrDrop is returned by forward when a request or its response was
+// dropped instead of being forwarded. Interceptors return it to drop a flow.
+var ErrDrop = errors.New("dropped by proxy")
+
+// forward runs a request through the recording pipeline shared by the plain
+// proxy and the MITM paths: match-and-replace rules, scripts, Go
+// interceptors, breakpoints, recording, sending it with send and recording
+// the response. Out-of-scope requests are sent unchanged, without rules,
+// scripts, interceptors, mocks, faults, breakpoints or recording, and come
+// back with a nil *RequestData. The caller is responsible for closing
+// the response body.
+func (p *ProxyHandler) forward(req *http.Request, send func(*http.Request) (*http.Response, error)) (*RequestData, *http.Response, error) {
+	if !p.scope.allowsURL(req.URL) {
+		resp, err := send(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to forward request: %w", err)
+		}
+		return nil, resp, nil
 	}
 
+	flow := &flowInfo{}
+	req = req.WithContext(withFlowInfo(req.Context(), flow))
+
+	fired, err := p.applyRequestRules(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	flow.AppliedRules = fired
+	p.runRequestScripts(req)
+
+	synthetic, err := p.interceptors.request(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if synthetic != nil {
+		send = func(*http.Request) (*http.Response, error) { return synthetic, nil }
+	} else if mock, ruleID := p.mockResponder(req); mock != nil {
+		send = mock
+		flow.MockRuleID = ruleID
+	}
+
+	fault := p.faults.plan(req)
+	if fault != nil {
+		flow.Fault = fault.record()
+	}
+
+	req, err = p.interceptRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reqData, err := p.saveRequest(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to save request: %v", err)
+	}
+	p.saveScriptErrors(reqData.ID, flow)
+
+	timing := newTimingTrace()
+	trace := timing.clientTrace()
+	trace.GotConn = func(info httptrace.GotConnInfo) {
+		flow.UpstreamAddr = info.Conn.RemoteAddr().String()
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := fault.send(req, send)
+	if err != nil {
+		p.saveRequestError(reqData.ID, err)
+		return nil, nil, fmt.Errorf("failed to forward request: %w", err)
+	}
+	if flow.MockRuleID == 0 {
+		p.saveUpstreamConn(reqData.ID, flow.UpstreamAddr, resp.TLS)
+	}
+
+	fired, err = p.applyResponseRules(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	if len(fired) > 0 {
+		flow.AppliedRules = append(flow.AppliedRules, fired...)
+		if err := p.store.UpdateAppliedRules(reqData.ID, flow.AppliedRules); err != nil {
+			log.Printf("Failed to save applied rules for %s: %v", reqData.ID, err)
+		}
+	}
+	p.runResponseScripts(resp)
+	p.saveScriptErrors(reqData.ID, flow)
+	if err := p.interceptors.response(resp); err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+
+	intercepted, err := p.interceptResponse(req, resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	resp = intercepted
+
+	if err := p.saveResponse(reqData.ID, resp, timing); err != nil {
+		log.Printf("Failed to save response for %s: %v", reqData.ID, err)
+	}
+
+	return reqData, resp, nil
+}
+
+// saveRequestError links an upstream failure to the recorded request.
+func (p *ProxyHandler) saveRequestError(id string, err error) {
+	reqErr := &RequestError{
+		RequestID: id,
+		Kind:      upstreamErrorKind(err),
+		Message:   err.Error(),
+		Timestamp: time.Now(),
+	}
+	if err := p.store.SaveRequestError(reqErr); err != nil {
+		log.Printf("Failed to save error for %s: %v", id, err)
+	}
+}
+
+// parseRequest extracts the parts of r that are stored and shown to
+// scripts. The body is not read.
+func parseRequest(r *http.Request) ParsedRequest {
 	parsedReq := ParsedRequest{
 		Method:     r.Method,
 		Scheme:     r.URL.Scheme,
@@ -118,7 +355,6 @@ func (p *ProxyHandler) saveRequest(r *http.Request) (*RequestData, error) {
 		Headers:    make(map[string]string),
 		Cookies:    make(map[string]string),
 		PostParams: make(map[string]string),
-		RawBody:    bodyBytes,
 	}
 
 	if parsedReq.Scheme == "" {
@@ -148,24 +384,30 @@ func (p *ProxyHandler) saveRequest(r *http.Request) (*RequestData, error) {
 		}
 	}
 
-	if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
-		if err := r.ParseForm(); err == nil {
-			for k, v := range r.PostForm {
-				if len(v) > 0 {
-					parsedReq.PostParams[k] = v[0]
-				}
-			}
-		}
-	}
+	return parsedReq
+}
 
+func (p *ProxyHandler) saveRequest(r *http.Request) (*RequestData, error) {
+	parsedReq := parseRequest(r)
+
+	ci := connInfoFrom(r.Context())
 	reqData := &RequestData{
 		ID:        generateID(),
 		Method:    r.Method,
 		URL:       r.URL.String(),
 		Headers:   r.Header,
-		Body:      bodyBytes,
 		Timestamp: time.Now(),
 		Parsed:    parsedReq,
+		ConnID:    ci.ID,
+		Proto:     r.Proto,
+
+		ClientAddr: ci.ClientAddr,
+		ClientTLS:  ci.TLS,
+		User:       ci.User,
+		Fault:      flowInfoFrom(r.Context()).Fault,
+		MockRuleID: flowInfoFrom(r.Context()).MockRuleID,
+
+		AppliedRules: flowInfoFrom(r.Context()).AppliedRules,
 	}
 
 	log.Printf("Request received: %v", r)
@@ -176,36 +418,67 @@ func (p *ProxyHandler) saveRequest(r *http.Request) (*RequestData, error) {
 		return nil, err
 	}
 
-	return reqData, nil
-}
-
-func (p *ProxyHandler) saveResponse(id string, resp *http.Response) error {
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-
-	if strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
-		gr, err := gzip.NewReader(bytes.NewReader(bodyBytes))
-		if err == nil {
-			defer gr.Close()
-			decompressed, err := io.ReadAll(gr)
-			if err == nil {
-				bodyBytes = decompressed
+	isForm := r.Header.Get("Content-Type") == "application/x-www-form-urlencoded"
+	encoding := strings.Join(r.Header.Values("Content-Encoding"), ",")
+	captureBody(&r.Body, p.cfg.Capture, spoolFileName(reqData.ID, "request"), func(body capturedBody) {
+		body.decode(encoding, p.cfg.Capture.MaxBodySize)
+		postParams := make(map[string]string)
+		if isForm && !body.Truncated {
+			if form, err := url.ParseQuery(string(body.analysisData())); err == nil {
+				for k, v := range form {
+					if len(v) > 0 {
+						postParams[k] = v[0]
+					}
+				}
 			}
 		}
-	}
+		if err := p.store.UpdateRequestBody(reqData.ID, body, postParams); err != nil {
+			log.Printf("Error saving request body for %s: %v", reqData.ID, err)
+		}
+	})
+
+	return reqData, nil
+}
 
+// parseResponse extracts the status line and headers of resp. The body is
+// not read.
+func parseResponse(resp *http.Response) ParsedResponse {
 	parsedResp := ParsedResponse{
 		Code:    resp.StatusCode,
 		Message: resp.Status,
 		Headers: make(map[string]string),
-		Body:    bodyBytes,
 	}
 
 	for k, v := range resp.Header {
 		parsedResp.Headers[k] = strings.Join(v, ", ")
 	}
+	return parsedResp
+}
+
+// saveResponse records resp and, once its body has been read, the timing of
+// the whole exchange.
+func (p *ProxyHandler) saveResponse(id string, resp *http.Response, timing *timingTrace) error {
+	parsedResp := parseResponse(resp)
+
+	if err := p.store.UpdateResponse(id, parsedResp); err != nil {
+		return err
+	}
+
+	// The body of a 101 response is the upgraded connection itself.
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil || resp.Body == http.NoBody {
+		p.saveTiming(id, timing)
+		return nil
+	}
 
-	return p.store.UpdateResponse(id, parsedResp)
+	encoding := strings.Join(resp.Header.Values("Content-Encoding"), ",")
+	captureBody(&resp.Body, p.cfg.Capture, spoolFileName(id, "response"), func(body capturedBody) {
+		p.saveTiming(id, timing)
+		body.decode(encoding, p.cfg.Capture.MaxBodySize)
+		if err := p.store.UpdateResponseBody(id, body); err != nil {
+			log.Printf("Error saving response body for %s: %v", id, err)
+		}
+	})
+	return nil
 }
 
 func generateID() string {
@@ -230,6 +503,20 @@ func NewDBStore(dsn string) (*DBStore, error) {
 	return &DBStore{db: db}, nil
 }
 
+// Migrate brings the database schema up to date by running schema, which
+// must be idempotent.
+func (s *DBStore) Migrate(schema string) error {
+	if _, err := s.db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to migrate DB: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database once no more writes are expected.
+func (s *DBStore) Close() error {
+	return s.db.Close()
+}
+
 func (s *DBStore) SaveRequest(req *RequestData) error {
 	getParams, err := toJSONB(req.Parsed.GetParams)
 	if err != nil {
@@ -251,11 +538,27 @@ func (s *DBStore) SaveRequest(req *RequestData) error {
 		return err
 	}
 
+	appliedRules, err := toJSONB(req.AppliedRules)
+	if err != nil {
+		return err
+	}
+
+	clientTLS, err := tlsInfoJSON(req.ClientTLS)
+	if err != nil {
+		return err
+	}
+
+	fault, err := faultJSON(req.Fault)
+	if err != nil {
+		return err
+	}
+
 	_, err = s.db.Exec(`
     INSERT INTO requests (
         id, method, scheme, host, path, get_params, headers, cookies, 
-        post_params, raw_body, timestamp
-    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        post_params, raw_body, timestamp, conn_id, proto, applied_rules,
+        client_addr, client_tls, proxy_user, fault, mock_rule_id
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
 `,
 		req.ID,
 		req.Parsed.Method,
@@ -268,6 +571,14 @@ func (s *DBStore) SaveRequest(req *RequestData) error {
 		postParams,
 		req.Parsed.RawBody,
 		req.Timestamp,
+		req.ConnID,
+		req.Proto,
+		appliedRules,
+		req.ClientAddr,
+		clientTLS,
+		req.User,
+		fault,
+		sql.NullInt64{Int64: req.MockRuleID, Valid: req.MockRuleID != 0},
 	)
 
 	return err
@@ -303,7 +614,8 @@ func toJSONB(data interface{}) ([]byte, error) {
 func (s *DBStore) GetRequest(id string) (*RequestData, error) {
 	var req RequestData
 	var getParams, headers, cookies, postParams, rawBody []byte
-	var responseHeaders []byte
+	var responseHeaders, appliedRules []byte
+	var clientTLS, upstreamTLS, fault []byte
 	var timestamp time.Time
 
 	req.Response = &ResponseData{}
@@ -311,8 +623,15 @@ func (s *DBStore) GetRequest(id string) (*RequestData, error) {
 	err := s.db.QueryRow(`
         SELECT 
             id, method, scheme, host, path, get_params, headers, cookies, 
-            post_params, raw_body, timestamp,
-            response_code, response_message, response_headers, response_body
+            post_params, raw_body, decoded_body, timestamp, COALESCE(conn_id, ''), COALESCE(proto, ''),
+            COALESCE(body_length, 0), COALESCE(body_truncated, FALSE), COALESCE(body_file, ''),
+            applied_rules,
+            response_code, response_message, response_headers, response_body, response_raw_body,
+            COALESCE(response_body_length, 0), COALESCE(response_truncated, FALSE), COALESCE(response_body_file, ''),
+            COALESCE(timing_dns_ms, 0), COALESCE(timing_connect_ms, 0), COALESCE(timing_tls_ms, 0),
+            COALESCE(timing_ttfb_ms, 0), COALESCE(timing_total_ms, 0),
+            COALESCE(client_addr, ''), client_tls, COALESCE(upstream_addr, ''), upstream_tls,
+            COALESCE(proxy_user, ''), fault, COALESCE(mock_rule_id, 0)
         FROM requests WHERE id = $1
     `, id).Scan(
 		&req.ID,
@@ -325,11 +644,34 @@ func (s *DBStore) GetRequest(id string) (*RequestData, error) {
 		&cookies,
 		&postParams,
 		&rawBody,
+		&req.Parsed.DecodedBody,
 		&timestamp,
+		&req.ConnID,
+		&req.Proto,
+		&req.BodyLength,
+		&req.BodyTruncated,
+		&req.BodyFile,
+		&appliedRules,
 		&req.Response.StatusCode,
 		&req.Response.Status,
 		&responseHeaders,
 		&req.Response.Body,
+		&req.Response.RawBody,
+		&req.Response.BodyLength,
+		&req.Response.Truncated,
+		&req.Response.BodyFile,
+		&req.Timing.DNSMs,
+		&req.Timing.ConnectMs,
+		&req.Timing.TLSMs,
+		&req.Timing.TTFBMs,
+		&req.Timing.TotalMs,
+		&req.ClientAddr,
+		&clientTLS,
+		&req.UpstreamAddr,
+		&upstreamTLS,
+		&req.User,
+		&fault,
+		&req.MockRuleID,
 	)
 
 	if err != nil {
@@ -363,6 +705,12 @@ func (s *DBStore) GetRequest(id string) (*RequestData, error) {
 	json.Unmarshal(headers, &req.Parsed.Headers)
 	json.Unmarshal(cookies, &req.Parsed.Cookies)
 	json.Unmarshal(postParams, &req.Parsed.PostParams)
+	json.Unmarshal(appliedRules, &req.AppliedRules)
+	req.ClientTLS = tlsInfoFromJSON(clientTLS)
+	req.UpstreamTLS = tlsInfoFromJSON(upstreamTLS)
+	if len(fault) > 0 {
+		json.Unmarshal(fault, &req.Fault)
+	}
 	req.Parsed.RawBody = rawBody
 	req.Timestamp = timestamp
 
@@ -389,14 +737,36 @@ func (p *ProxyHandler) ResendRequest(id string) (*http.Response, error) {
 	}
 
 	var body io.Reader
-	if len(reqRecord.Parsed.RawBody) > 0 {
+	var length int64
+	if reqRecord.BodyTruncated {
+		// Only the head of the body is in the database; the full body
+		// is in its spool file.
+		if reqRecord.BodyFile == "" {
+			return nil, fmt.Errorf("stored body of %s is truncated and was not spooled", id)
+		}
+		f, err := os.Open(reqRecord.BodyFile)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		body, length = f, info.Size()
+	} else if len(reqRecord.Parsed.RawBody) > 0 {
 		body = bytes.NewReader(reqRecord.Parsed.RawBody)
+		length = int64(len(reqRecord.Parsed.RawBody))
 	}
 
 	req, err := http.NewRequest(reqRecord.Parsed.Method, urlStr, body)
 	if err != nil {
+		if c, ok := body.(io.Closer); ok {
+			c.Close()
+		}
 		return nil, err
 	}
+	req.ContentLength = length
 
 	for k, v := range reqRecord.Parsed.Headers {
 		req.Header.Set(k, v)
@@ -406,8 +776,7 @@ func (p *ProxyHandler) ResendRequest(id string) (*http.Response, error) {
 		req.AddCookie(&http.Cookie{Name: k, Value: v})
 	}
 
-	client := &http.Client{}
-	return client.Do(req)
+	return p.transport.RoundTrip(req)
 }
 
 func (s *DBStore) GetAll() ([]*RequestData, error) {
@@ -416,8 +785,15 @@ func (s *DBStore) GetAll() ([]*RequestData, error) {
 	rows, err := s.db.Query(`
         SELECT 
             id, method, scheme, host, path, get_params, headers, cookies, 
-            post_params, raw_body, timestamp,
-            response_code, response_message, response_headers, response_body
+            post_params, raw_body, decoded_body, timestamp, COALESCE(conn_id, ''), COALESCE(proto, ''),
+            COALESCE(body_length, 0), COALESCE(body_truncated, FALSE), COALESCE(body_file, ''),
+            applied_rules,
+            response_code, response_message, response_headers, response_body, response_raw_body,
+            COALESCE(response_body_length, 0), COALESCE(response_truncated, FALSE), COALESCE(response_body_file, ''),
+            COALESCE(timing_dns_ms, 0), COALESCE(timing_connect_ms, 0), COALESCE(timing_tls_ms, 0),
+            COALESCE(timing_ttfb_ms, 0), COALESCE(timing_total_ms, 0),
+            COALESCE(client_addr, ''), client_tls, COALESCE(upstream_addr, ''), upstream_tls,
+            COALESCE(proxy_user, ''), fault, COALESCE(mock_rule_id, 0)
         FROM requests
         ORDER BY timestamp DESC
     `)
@@ -436,7 +812,8 @@ func (s *DBStore) GetAll() ([]*RequestData, error) {
 	for rows.Next() {
 		var req RequestData
 		var getParams, headers, cookies, postParams []byte
-		var responseHeaders []byte
+		var responseHeaders, appliedRules []byte
+		var clientTLS, upstreamTLS, fault []byte
 
 		req.Parsed = ParsedRequest{
 			GetParams:  make(map[string]string),
@@ -460,11 +837,34 @@ func (s *DBStore) GetAll() ([]*RequestData, error) {
 			&cookies,
 			&postParams,
 			&req.Parsed.RawBody,
+			&req.Parsed.DecodedBody,
 			&req.Timestamp,
+			&req.ConnID,
+			&req.Proto,
+			&req.BodyLength,
+			&req.BodyTruncated,
+			&req.BodyFile,
+			&appliedRules,
 			&responseCode,
 			&req.Response.Status,
 			&responseHeaders,
 			&req.Response.Body,
+			&req.Response.RawBody,
+			&req.Response.BodyLength,
+			&req.Response.Truncated,
+			&req.Response.BodyFile,
+			&req.Timing.DNSMs,
+			&req.Timing.ConnectMs,
+			&req.Timing.TLSMs,
+			&req.Timing.TTFBMs,
+			&req.Timing.TotalMs,
+			&req.ClientAddr,
+			&clientTLS,
+			&req.UpstreamAddr,
+			&upstreamTLS,
+			&req.User,
+			&fault,
+			&req.MockRuleID,
 		)
 		if err != nil {
 			log.Printf("[DB] Failed to scan row: %v\n", err)
@@ -494,6 +894,14 @@ func (s *DBStore) GetAll() ([]*RequestData, error) {
 		if len(postParams) > 0 {
 			_ = json.Unmarshal(postParams, &req.Parsed.PostParams)
 		}
+		if len(appliedRules) > 0 {
+			_ = json.Unmarshal(appliedRules, &req.AppliedRules)
+		}
+		req.ClientTLS = tlsInfoFromJSON(clientTLS)
+		req.UpstreamTLS = tlsInfoFromJSON(upstreamTLS)
+		if len(fault) > 0 {
+			_ = json.Unmarshal(fault, &req.Fault)
+		}
 		if len(responseHeaders) > 0 {
 			var rawHeaders map[string]interface{}
 			if err := json.Unmarshal(responseHeaders, &rawHeaders); err == nil {
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// HostMapping sends connections for hosts matching a glob to Target instead
+// of the resolved address. Target is "ip", "ip:port" or "host:port"; without
+// a port the original one is kept. Host headers and SNI are not changed.
+// When the host is reached through an upstream proxy, the proxy is asked to
+// connect to Target; plain HTTP requests are then tunnelled with CONNECT
+// instead of being handed to the proxy by name.
+type HostMapping struct {
+	ID      int64  `json:"id"`
+	Host    string `json:"host"`
+	Target  string `json:"target"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (m *HostMapping) validate() error {
+	if m.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if m.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if _, _, err := net.SplitHostPort(m.Target); err != nil && net.ParseIP(m.Target) == nil {
+		return fmt.Errorf("target must be ip, ip:port or host:port, got %q", m.Target)
+	}
+	return nil
+}
+
+// hostMap holds the enabled host mappings. The first match wins.
+type hostMap struct {
+	mu       sync.RWMutex
+	mappings []*HostMapping
+}
+
+func (h *hostMap) set(mappings []*HostMapping) {
+	var enabled []*HostMapping
+	for _, m := range mappings {
+		if m.Enabled {
+			enabled = append(enabled, m)
+		}
+	}
+
+	h.mu.Lock()
+	h.mappings = enabled
+	h.mu.Unlock()
+}
+
+// rewrite returns the address to dial for addr (host:port).
+func (h *hostMap) rewrite(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, m := range h.mappings {
+		if !matchHost(m.Host, host) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(m.Target); err == nil {
+			return m.Target
+		}
+		return net.JoinHostPort(m.Target, port)
+	}
+	return addr
+}
+
+// mapped reports whether a mapping applies to addr (host:port).
+func (h *hostMap) mapped(addr string) bool {
+	return h.rewrite(addr) != addr
+}
+
+// hostDialer opens every outbound TCP connection. It applies the host
+// mappings and resolves names with the configured DNS server, if any.
+type hostDialer struct {
+	dialer net.Dialer
+	hosts  *hostMap
+}
+
+func newHostDialer(cfg TransportConfig, hosts *hostMap) *hostDialer {
+	d := &hostDialer{
+		dialer: net.Dialer{Timeout: cfg.DialTimeout, KeepAlive: 30 * time.Second},
+		hosts:  hosts,
+	}
+	if d.dialer.Timeout == 0 {
+		d.dialer.Timeout = upstreamDialTimeout
+	}
+
+	if cfg.Resolver != "" {
+		server := cfg.Resolver
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		d.dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var nd net.Dialer
+				return nd.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return d
+}
+
+func (d *hostDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, network, d.hosts.rewrite(addr))
+}
+
+func (d *hostDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (p *ProxyHandler) ReloadHostMappings() error {
+	mappings, err := p.store.GetHostMappings()
+	if err != nil {
+		return err
+	}
+	p.hosts.set(mappings)
+	// Pooled connections still point at the old addresses.
+	p.transport.CloseIdleConnections()
+	return nil
+}
+
+func (p *ProxyHandler) CreateHostMapping(m *HostMapping) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if err := p.store.CreateHostMapping(m); err != nil {
+		return err
+	}
+	return p.ReloadHostMappings()
+}
+
+func (p *ProxyHandler) UpdateHostMapping(m *HostMapping) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if err := p.store.UpdateHostMapping(m); err != nil {
+		return err
+	}
+	return p.ReloadHostMappings()
+}
+
+func (p *ProxyHandler) DeleteHostMapping(id int64) error {
+	if err := p.store.DeleteHostMapping(id); err != nil {
+		return err
+	}
+	return p.ReloadHostMappings()
+}
+
+func (s *DBStore) GetHostMappings() ([]*HostMapping, error) {
+	rows, err := s.db.Query(`
+        SELECT id, host, target, enabled
+        FROM host_mappings
+        ORDER BY id
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query host mappings: %v", err)
+	}
+	defer rows.Close()
+
+	mappings := []*HostMapping{}
+	for rows.Next() {
+		var m HostMapping
+		if err := rows.Scan(&m.ID, &m.Host, &m.Target, &m.Enabled); err != nil {
+			return nil, fmt.Errorf("failed to scan host mapping row: %v", err)
+		}
+		mappings = append(mappings, &m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return mappings, nil
+}
+
+func (s *DBStore) CreateHostMapping(m *HostMapping) error {
+	return s.db.QueryRow(`
+        INSERT INTO host_mappings (host, target, enabled)
+        VALUES ($1, $2, $3)
+        RETURNING id
+    `, m.Host, m.Target, m.Enabled).Scan(&m.ID)
+}
+
+func (s *DBStore) UpdateHostMapping(m *HostMapping) error {
+	res, err := s.db.Exec(`
+        UPDATE host_mappings SET host = $1, target = $2, enabled = $3
+        WHERE id = $4
+    `, m.Host, m.Target, m.Enabled, m.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *DBStore) DeleteHostMapping(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM host_mappings WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultInterceptTimeout = 60 * time.Second
+
+// InterceptSettings controls which flows are held for manual review.
+type InterceptSettings struct {
+	Enabled bool `json:"enabled"`
+	// Responses also holds the responses of matching requests.
+	Responses bool `json:"responses"`
+	// Host is a glob such as "*.example.com". Empty matches every host.
+	Host string `json:"host"`
+	// PathPrefix restricts interception to matching paths.
+	PathPrefix string `json:"path_prefix"`
+	// TimeoutSeconds is how long an item waits before it is forwarded
+	// unchanged. Zero means the default of 60 seconds.
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// InterceptedItem is a request or response waiting for a decision.
+type InterceptedItem struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+	// BodyOmitted is set when the body is not held but streams through
+	// once the item is released: event streams, bodies without a declared
+	// length and bodies larger than the capture limit.
+	BodyOmitted bool      `json:"body_omitted,omitempty"`
+	Created     time.Time `json:"created"`
+
+	decision chan InterceptDecision
+}
+
+// InterceptDecision resolves a pending item. Empty fields of an edit keep
+// the original value.
+type InterceptDecision struct {
+	Drop       bool        `json:"drop"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+}
+
+type interceptQueue struct {
+	mu       sync.Mutex
+	settings InterceptSettings
+	pending  map[string]*InterceptedItem
+}
+
+func newInterceptQueue() *interceptQueue {
+	return &interceptQueue{pending: make(map[string]*InterceptedItem)}
+}
+
+func (q *interceptQueue) matches(req *http.Request, response bool) (bool, time.Duration) {
+	q.mu.Lock()
+	s := q.settings
+	q.mu.Unlock()
+
+	if !s.Enabled || (response && !s.Responses) {
+		return false, 0
+	}
+	if s.Host != "" && !matchHost(s.Host, req.URL.Host) {
+		return false, 0
+	}
+	if s.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, s.PathPrefix) {
+		return false, 0
+	}
+
+	timeout := defaultInterceptTimeout
+	if s.TimeoutSeconds > 0 {
+		timeout = time.Duration(s.TimeoutSeconds) * time.Second
+	}
+	return true, timeout
+}
+
+// hold queues item and blocks until it is resolved through the API, the
+// timeout forwards it unchanged or the client goes away.
+func (q *interceptQueue) hold(req *http.Request, item *InterceptedItem, timeout time.Duration) InterceptDecision {
+	item.ID = generateID()
+	item.Created = time.Now()
+	item.decision = make(chan InterceptDecision, 1)
+
+	q.mu.Lock()
+	q.pending[item.ID] = item
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		delete(q.pending, item.ID)
+		q.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case d := <-item.decision:
+		return d
+	case <-timer.C:
+		return InterceptDecision{}
+	case <-req.Context().Done():
+		return InterceptDecision{Drop: true}
+	}
+}
+
+func (p *ProxyHandler) InterceptSettings() InterceptSettings {
+	p.intercept.mu.Lock()
+	defer p.intercept.mu.Unlock()
+	return p.intercept.settings
+}
+
+func (p *ProxyHandler) SetInterceptSettings(s InterceptSettings) {
+	p.intercept.mu.Lock()
+	defer p.intercept.mu.Unlock()
+	p.intercept.settings = s
+}
+
+// PendingIntercepts lists the held items, oldest first.
+func (p *ProxyHandler) PendingIntercepts() []*InterceptedItem {
+	p.intercept.mu.Lock()
+	defer p.intercept.mu.Unlock()
+
+	items := make([]*InterceptedItem, 0, len(p.intercept.pending))
+	for _, item := range p.intercept.pending {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+	return items
+}
+
+// ResolveIntercept forwards or drops a held item.
+func (p *ProxyHandler) ResolveIntercept(id string, d InterceptDecision) error {
+	p.intercept.mu.Lock()
+	item, ok := p.intercept.pending[id]
+	delete(p.intercept.pending, id)
+	p.intercept.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("intercepted item %s not found", id)
+	}
+	item.decision <- d
+	return nil
+}
+
+// interceptRequest holds req if it matches the intercept settings and
+// applies the edits it was released with.
+func (p *ProxyHandler) interceptRequest(req *http.Request) (*http.Request, error) {
+	ok, timeout := p.intercept.matches(req, false)
+	if !ok {
+		return req, nil
+	}
+
+	body, ok, err := p.bufferableBody(&req.Body, req.ContentLength, req.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %v", err)
+	}
+
+	d := p.intercept.hold(req, &InterceptedItem{
+		Kind:        "request",
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		Headers:     req.Header.Clone(),
+		Body:        body,
+		BodyOmitted: !ok,
+	}, timeout)
+	if d.Drop {
+		return nil, ErrDrop
+	}
+
+	if d.Method != "" {
+		req.Method = d.Method
+	}
+	if d.URL != "" {
+		u, err := url.Parse(d.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid edited URL: %v", err)
+		}
+		req.URL = u
+		req.Host = u.Host
+	}
+	if d.Headers != nil {
+		req.Header = canonicalHeader(d.Headers)
+	}
+	if d.Body != nil {
+		if !ok {
+			req.Body.Close()
+		}
+		setRequestBody(req, d.Body)
+	}
+
+	return req, nil
+}
+
+// interceptResponse holds resp if the request matches the intercept
+// settings for responses and applies the edits it was released with.
+func (p *ProxyHandler) interceptResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+	ok, timeout := p.intercept.matches(req, true)
+	if !ok {
+		return resp, nil
+	}
+
+	body, ok, err := p.bufferableBody(&resp.Body, resp.ContentLength, resp.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	d := p.intercept.hold(req, &InterceptedItem{
+		Kind:        "response",
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		StatusCode:  resp.StatusCode,
+		Headers:     resp.Header.Clone(),
+		Body:        body,
+		BodyOmitted: !ok,
+	}, timeout)
+	if d.Drop {
+		return nil, ErrDrop
+	}
+
+	if d.StatusCode != 0 {
+		resp.StatusCode = d.StatusCode
+		resp.Status = fmt.Sprintf("%d %s", d.StatusCode, http.StatusText(d.StatusCode))
+	}
+	if d.Headers != nil {
+		resp.Header = canonicalHeader(d.Headers)
+	}
+	if d.Body != nil {
+		if !ok {
+			resp.Body.Close()
+		}
+		setResponseBody(resp, d.Body)
+	}
+
+	return resp, nil
+}
+
+// canonicalHeader rebuilds a header decoded from JSON so that lookups work
+// regardless of the key case used by the client.
+func canonicalHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vv := range h {
+		for _, v := range vv {
+			out.Add(k, v)
+		}
+	}
+	return out
+}
+
+// readBody reads and closes *body, leaving a replayable copy in its place.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	data, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, err
+}
+
+// readBodyLimited is readBody for bodies of at most limit bytes. A longer
+// body is left to stream as it was and reported as incomplete. A limit of
+// zero reads everything.
+func readBodyLimited(body *io.ReadCloser, limit int64) ([]byte, bool, error) {
+	if limit <= 0 || *body == nil || *body == http.NoBody {
+		data, err := readBody(body)
+		return data, true, err
+	}
+	orig := *body
+	data, err := io.ReadAll(io.LimitReader(orig, limit+1))
+	if int64(len(data)) > limit {
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), orig), orig}
+		return nil, false, err
+	}
+	orig.Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	return data, true, err
+}
+
+// bufferableBody reads a body that can be held in memory without stalling
+// a stream: one with a declared length within the capture limit that is not
+// an event stream. Otherwise it returns false and leaves the body to stream.
+func (p *ProxyHandler) bufferableBody(body *io.ReadCloser, length int64, h http.Header) ([]byte, bool, error) {
+	limit := p.cfg.Capture.MaxBodySize
+	if length < 0 || (limit > 0 && length > limit) || isStreamingContent(h) {
+		return nil, false, nil
+	}
+	return readBodyLimited(body, limit)
+}
+
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Header.Del("Content-Length")
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+}
+
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
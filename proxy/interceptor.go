@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Interceptor is a Go hook into every flow the proxy handles, on the plain
+// and reverse listeners as well as inside MITM tunnels. Interceptors are
+// set in Config.Interceptors and run in that order; embed NopInterceptor to
+// implement only some of the hooks. Hooks run concurrently for different
+// flows. An interceptor that also implements WebSocketInterceptor sees
+// WebSocket messages.
+type Interceptor interface {
+	// OnConnect is called when a tunnel is opened, before it is intercepted
+	// or relayed. An error closes the tunnel.
+	OnConnect(info *ConnectInfo) error
+	// OnRequest runs after the match-and-replace rules and may modify req
+	// in place. A non-nil response answers the request without contacting
+	// the upstream and skips the remaining interceptors. ErrDrop drops the
+	// request.
+	OnRequest(req *http.Request) (*http.Response, error)
+	// OnResponse runs after the response rules and may modify resp in
+	// place, including replacing its Body. ErrDrop drops the response.
+	OnResponse(resp *http.Response) error
+}
+
+// WebSocketInterceptor is an Interceptor that also hooks into WebSocket
+// traffic. While one is configured, messages are reassembled and relayed as
+// single frames instead of being copied frame by frame, and messages larger
+// than 16 MiB end the connection.
+type WebSocketInterceptor interface {
+	Interceptor
+	// OnWebSocketMessage is called for every complete data message. It may
+	// change msg.Payload; ErrDrop keeps the message from being relayed.
+	OnWebSocketMessage(msg *WebSocketMessage) error
+}
+
+// ConnectInfo describes a tunnel being opened. Target is empty for
+// transparent connections, whose destination is only learned from the
+// traffic.
+type ConnectInfo struct {
+	Target     string
+	ClientAddr string
+	User       string
+}
+
+// NopInterceptor implements every Interceptor hook by doing nothing.
+type NopInterceptor struct{}
+
+func (NopInterceptor) OnConnect(*ConnectInfo) error                    { return nil }
+func (NopInterceptor) OnRequest(*http.Request) (*http.Response, error) { return nil, nil }
+func (NopInterceptor) OnResponse(*http.Response) error                 { return nil }
+
+type interceptorChain []Interceptor
+
+func (c interceptorChain) connect(info *ConnectInfo) error {
+	for _, i := range c {
+		if err := i.OnConnect(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c interceptorChain) request(req *http.Request) (*http.Response, error) {
+	for _, i := range c {
+		resp, err := i.OnRequest(req)
+		if err != nil {
+			return nil, interceptorError(err)
+		}
+		if resp != nil {
+			if resp.Request == nil {
+				resp.Request = req
+			}
+			if resp.Body == nil {
+				resp.Body = http.NoBody
+			}
+			if resp.StatusCode == 0 {
+				resp.StatusCode = http.StatusOK
+			}
+			if resp.Status == "" {
+				resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+			}
+			if resp.ProtoMajor == 0 {
+				resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+			}
+			if resp.Header == nil {
+				resp.Header = make(http.Header)
+			}
+			return resp, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c interceptorChain) response(resp *http.Response) error {
+	for _, i := range c {
+		if err := i.OnResponse(resp); err != nil {
+			return interceptorError(err)
+		}
+	}
+	return nil
+}
+
+// hasWebSocket reports whether any interceptor inspects WebSocket messages.
+func (c interceptorChain) hasWebSocket() bool {
+	for _, i := range c {
+		if _, ok := i.(WebSocketInterceptor); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c interceptorChain) webSocketMessage(msg *WebSocketMessage) error {
+	for _, i := range c {
+		ws, ok := i.(WebSocketInterceptor)
+		if !ok {
+			continue
+		}
+		if err := ws.OnWebSocketMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func interceptorError(err error) error {
+	if err == ErrDrop {
+		return err
+	}
+	return fmt.Errorf("interceptor: %w", err)
+}
+
+// HeaderInjector sets headers on requests and responses whose host matches
+// Host (a glob, empty for all hosts).
+type HeaderInjector struct {
+	NopInterceptor
+	Host     string
+	Request  http.Header
+	Response http.Header
+}
+
+func (h *HeaderInjector) OnRequest(req *http.Request) (*http.Response, error) {
+	if h.Host == "" || matchHost(h.Host, req.URL.Host) {
+		for k, vv := range h.Request {
+			req.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), vv...)
+		}
+	}
+	return nil, nil
+}
+
+func (h *HeaderInjector) OnResponse(resp *http.Response) error {
+	if resp.Request != nil && (h.Host == "" || matchHost(h.Host, resp.Request.URL.Host)) {
+		for k, vv := range h.Response {
+			resp.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), vv...)
+		}
+	}
+	return nil
+}
+
+// ParseHeaderLine parses a "Name: value" header line as given on the
+// command line.
+func ParseHeaderLine(line string) (string, string, error) {
+	name, value, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("expected \"Name: value\", got %q", line)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+// LogInterceptor logs every tunnel, request, response and WebSocket
+// message. A nil Logger logs to the standard logger.
+type LogInterceptor struct {
+	Logger *log.Logger
+}
+
+func (l *LogInterceptor) logf(format string, args ...interface{}) {
+	if l.Logger != nil {
+		l.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (l *LogInterceptor) OnConnect(info *ConnectInfo) error {
+	l.logf("[flow] CONNECT %s from %s", info.Target, info.ClientAddr)
+	return nil
+}
+
+func (l *LogInterceptor) OnRequest(req *http.Request) (*http.Response, error) {
+	l.logf("[flow] %s %s", req.Method, req.URL)
+	return nil, nil
+}
+
+func (l *LogInterceptor) OnResponse(resp *http.Response) error {
+	if resp.Request != nil {
+		l.logf("[flow] %s %s -> %s", resp.Request.Method, resp.Request.URL, resp.Status)
+	} else {
+		l.logf("[flow] -> %s", resp.Status)
+	}
+	return nil
+}
+
+func (l *LogInterceptor) OnWebSocketMessage(msg *WebSocketMessage) error {
+	l.logf("[flow] ws %s %s opcode=%d %d bytes", msg.RequestID, msg.Direction, msg.Opcode, len(msg.Payload))
+	return nil
+}
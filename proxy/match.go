@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net"
+	"path"
+	"strings"
+)
+
+// matchHost reports whether host matches a glob pattern such as
+// "*.example.com". A leading "*." also matches the bare domain. Any port on
+// host is ignored and the comparison is case-insensitive.
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(hostOnly(host))
+	pattern = strings.ToLower(pattern)
+
+	if strings.HasPrefix(pattern, "*.") && host == pattern[2:] {
+		return true
+	}
+	ok, err := path.Match(pattern, host)
+	return err == nil && ok
+}
+
+// hostOnly strips the port from a host[:port] string.
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
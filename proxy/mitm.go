@@ -4,19 +4,30 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
-func (p *ProxyHandler) handleHTTPS(w http.ResponseWriter, r *http.Request) {
-	host, _, err := net.SplitHostPort(r.Host)
-	if err != nil {
-		host = r.Host
-	}
+const (
+	mitmIdleTimeout = 90 * time.Second
+	mitmReadTimeout = 30 * time.Second
+	// tunnelSniffTimeout is how long a tunnel to a raw port waits for the
+	// client's first bytes before it is relayed as raw TCP.
+	tunnelSniffTimeout = 2 * time.Second
+
+	tlsRecordTypeHandshake = 0x16
+)
 
+func (p *ProxyHandler) handleHTTPS(w http.ResponseWriter, r *http.Request, user string) {
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
@@ -35,115 +46,414 @@ func (p *ProxyHandler) handleHTTPS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cert, err := p.certManager.GenerateCert(host)
-	if err != nil {
-		log.Printf("Certificate generation failed for %s: %v", host, err)
+	p.serveTunnel(clientConn, r.Host, user)
+}
+
+// serveTunnel intercepts the traffic of an established tunnel to target
+// (host:port). TLS is terminated with a certificate minted for the target
+// host and plain HTTP is parsed; any other protocol is relayed as raw TCP.
+// An empty target means the destination is taken from the TLS SNI or the
+// HTTP Host header, so such tunnels are always treated as HTTP. Tunnels to
+// out-of-scope targets and passthrough hosts are relayed untouched. user is
+// the authenticated proxy user, if any.
+func (p *ProxyHandler) serveTunnel(conn net.Conn, target, user string) {
+	if !p.conns.add(conn) {
 		return
 	}
+	defer p.conns.remove(conn)
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ServerName:   host,
-		MinVersion:   tls.VersionTLS12,
+	info := &ConnectInfo{Target: target, ClientAddr: conn.RemoteAddr().String(), User: user}
+	if err := p.interceptors.connect(info); err != nil {
+		log.Printf("Tunnel to %s refused by interceptor: %v", target, err)
+		return
 	}
 
-	tlsConn := tls.Server(clientConn, tlsConfig)
-	defer tlsConn.Close()
-
-	if err := tlsConn.Handshake(); err != nil {
-		log.Printf("TLS handshake with client failed: %v", err)
+	if target != "" && !p.scope.allowsTunnel(target) {
+		p.relayTunnel(conn, target)
 		return
 	}
 
-	bufReader := bufio.NewReader(tlsConn)
-	req, err := http.ReadRequest(bufReader)
-	if err != nil {
-		log.Printf("Failed to read HTTPS request: %v", err)
+	host := hostOnly(target)
+	if target != "" && p.passthrough.matches(host) {
+		p.passthroughTunnel(conn, target)
 		return
 	}
+	bc := newBufferedConn(conn)
 
-	req.URL.Scheme = "https"
-	req.URL.Host = req.Host
+	ci := newConnInfo()
+	ci.ClientAddr = conn.RemoteAddr().String()
+	ci.User = user
+	ci.conn = conn
 
-	reqData, err := p.saveRequest(req)
+	// Clients of server-first protocols (SMTP, MySQL, ...) send nothing
+	// until the upstream speaks, so a silent client is relayed, but only on
+	// the configured raw ports: browsers often open a tunnel well before
+	// they send their ClientHello.
+	timeout := mitmIdleTimeout
+	rawPort := target != "" && p.isRawPort(target)
+	if rawPort {
+		timeout = tunnelSniffTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	first, err := bc.r.Peek(1)
 	if err != nil {
-		log.Printf("Failed to save HTTPS request: %v", err)
+		var netErr net.Error
+		if rawPort && errors.As(err, &netErr) && netErr.Timeout() {
+			conn.SetReadDeadline(time.Time{})
+			p.rawTunnel(bc, target, ci)
+		}
+		return
+	}
+
+	if first[0] == tlsRecordTypeHandshake {
+		// The SNI may name a passthrough host the target did not, e.g. in
+		// transparent mode or when the client connected to an IP.
+		if sni := peekSNI(bc); sni != "" && p.passthrough.matches(sni) {
+			if target == "" {
+				target = net.JoinHostPort(sni, "443")
+			}
+			conn.SetReadDeadline(time.Time{})
+			p.passthroughTunnel(bc, target)
+			return
+		}
+		p.serveMITMTLS(bc, host, ci)
+		return
+	}
+	if target != "" && !looksLikeHTTP(bc.r) {
+		conn.SetReadDeadline(time.Time{})
+		p.rawTunnel(bc, target, ci)
 		return
 	}
+	p.serveMITMHTTP1(bc, bc.r, "http", target, ci)
+}
 
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         host,
+// serveMITMTLS terminates TLS on conn and serves the protocol negotiated with
+// the client via ALPN.
+func (p *ProxyHandler) serveMITMTLS(conn net.Conn, host string, ci *connInfo) {
+	// certName is the host the client is shown a certificate for.
+	certName := host
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{http2.NextProtoTLS, "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Clients that resolve names themselves connect to an IP but
+			// still expect a certificate for the name they asked for.
+			name := host
+			if name == "" || (net.ParseIP(name) != nil && hello.ServerName != "") {
+				name = hello.ServerName
+			}
+			certName = name
+			if name == "" {
+				return nil, fmt.Errorf("client sent no SNI and the destination is unknown")
+			}
+
+			cert, err := p.certManager.GenerateCert(name)
+			if err != nil {
+				log.Printf("Certificate generation failed for %s: %v", name, err)
+				return nil, err
+			}
+			return &cert, nil
 		},
 	}
-	resp, err := transport.RoundTrip(req)
-	if err != nil {
-		log.Printf("Failed to forward HTTPS request: %v", err)
+
+	tlsConn := tls.Server(conn, tlsConfig)
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("TLS handshake with client failed: %v", err)
+		if p.passthrough.handshakeFailed(certName, err) {
+			log.Printf("Switching %s to TLS passthrough after repeated certificate rejections", certName)
+		}
 		return
 	}
-	defer resp.Body.Close()
 
-	if err := p.saveResponse(reqData.ID, resp); err != nil {
-		log.Printf("Failed to save HTTPS response: %v", err)
+	// The deadline armed while waiting for the ClientHello must not cut
+	// off HTTP/2 connections, which set no read deadlines of their own.
+	tlsConn.SetReadDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	ci.TLS = tlsInfoFromState(&state)
+	if host == "" {
+		host = state.ServerName
 	}
+	p.passthrough.handshakeSucceeded(certName)
 
-	err = resp.Write(tlsConn)
-	if err != nil {
-		log.Printf("Failed to write HTTPS response back to client: %v", err)
+	if state.NegotiatedProtocol == http2.NextProtoTLS {
+		p.serveMITMHTTP2(tlsConn, ci)
+		return
 	}
+	p.serveMITMHTTP1(tlsConn, bufio.NewReader(tlsConn), "https", host, ci)
 }
 
-func (p *ProxyHandler) mitmConnection(clientConn net.Conn, host string) {
-	defer clientConn.Close()
+// serveMITMHTTP1 serves a persistent HTTP/1.1 connection. Requests are read in
+// a loop until the client or the upstream asks to close the connection or the
+// connection stays idle for too long. defaultHost is used for requests
+// without a Host header.
+func (p *ProxyHandler) serveMITMHTTP1(conn net.Conn, bufReader *bufio.Reader, scheme, defaultHost string, ci *connInfo) {
+	for {
+		if !p.conns.setIdle(ci.conn, true) {
+			return
+		}
+		// Wait up to the idle timeout for the next request, then give the
+		// client mitmReadTimeout to send its headers. The body is read
+		// without a deadline so that slow uploads are not cut off.
+		conn.SetReadDeadline(time.Now().Add(mitmIdleTimeout))
+		if _, err := bufReader.Peek(1); err != nil {
+			if err != io.EOF && !isTimeoutError(err) && !isClosedConnError(err) {
+				log.Printf("Failed to read %s request: %v", scheme, err)
+			}
+			return
+		}
+		p.conns.setIdle(ci.conn, false)
+		conn.SetReadDeadline(time.Now().Add(mitmReadTimeout))
+		req, err := http.ReadRequest(bufReader)
+		if err != nil {
+			if err != io.EOF && !isTimeoutError(err) && !isClosedConnError(err) {
+				log.Printf("Failed to read %s request: %v", scheme, err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
 
-	cert, err := p.certManager.GenerateCert(host)
-	if err != nil {
-		log.Printf("Failed to generate cert for %s: %v", host, err)
-		return
+		ctx, cancel := context.WithCancel(withConnInfo(p.conns.ctx, ci))
+		req = req.WithContext(ctx)
+		watch := watchClientClose(conn, bufReader, req, cancel)
+		if req.Host == "" {
+			req.Host = defaultHost
+		}
+		req.URL.Scheme = scheme
+		req.URL.Host = req.Host
+		if isWebSocketUpgrade(req) {
+			prepareWebSocketRequest(req)
+		}
+
+		reqData, resp, err := p.forward(req, p.transport.RoundTrip)
+		if err != nil {
+			watch.stop()
+			cancel()
+			if errors.Is(err, errFaultReset) {
+				return
+			}
+			log.Printf("[%s] %v", ci.ID, err)
+			writeErrorResponse(conn, http.StatusBadGateway, err.Error())
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			watch.stop()
+			p.relayUpgrade(conn, bufReader, resp, reqData)
+			cancel()
+			return
+		}
+
+		err = resp.Write(conn)
+		resp.Body.Close()
+		watch.stop()
+		cancel()
+		if err != nil {
+			log.Printf("Failed to write %s response back to client: %v", scheme, err)
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
 	}
+}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ServerName:   host,
+// clientCloseWatch cancels the context of a request served on a MITM
+// HTTP/1.1 connection when the client goes away before the exchange is
+// over, e.g. while the request is held at a breakpoint. Like net/http, it
+// detects that with a background read started once the request body has
+// been consumed.
+type clientCloseWatch struct {
+	conn      net.Conn
+	br        *bufio.Reader
+	cancel    context.CancelFunc
+	startOnce sync.Once
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+// watchClientClose starts watching conn for req right away if it has no
+// body, or once its body has been read to the end.
+func watchClientClose(conn net.Conn, br *bufio.Reader, req *http.Request, cancel context.CancelFunc) *clientCloseWatch {
+	w := &clientCloseWatch{conn: conn, br: br, cancel: cancel}
+	if req.Body == nil || req.Body == http.NoBody {
+		w.start()
+	} else {
+		req.Body = &eofSignalBody{ReadCloser: req.Body, onEOF: w.start}
 	}
+	return w
+}
 
-	tlsConn := tls.Server(clientConn, tlsConfig)
-	defer tlsConn.Close()
+func (w *clientCloseWatch) start() {
+	w.startOnce.Do(func() {
+		w.done = make(chan struct{})
+		go func() {
+			defer close(w.done)
+			// A pipelined request only makes the peek return early; it
+			// stays buffered for the next iteration.
+			if _, err := w.br.Peek(1); err != nil && !isTimeoutError(err) {
+				w.cancel()
+			}
+		}()
+	})
+}
 
-	if err := tlsConn.Handshake(); err != nil {
-		log.Printf("TLS handshake failed for %s: %v", host, err)
-		return
+// stop ends the background read so that the connection can be read again.
+func (w *clientCloseWatch) stop() {
+	w.stopOnce.Do(func() {
+		// Keeps a body read after this point from starting the watch.
+		w.startOnce.Do(func() {})
+		if w.done == nil {
+			return
+		}
+		w.conn.SetReadDeadline(time.Unix(1, 0))
+		<-w.done
+		w.conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// eofSignalBody calls onEOF when its body has been read to the end.
+type eofSignalBody struct {
+	io.ReadCloser
+	onEOF func()
+}
+
+func (b *eofSignalBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.onEOF()
 	}
+	return n, err
+}
 
-	reader := bufio.NewReader(tlsConn)
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		log.Printf("Failed to read request from %s: %v", host, err)
-		return
+// newMITMHTTP2Server returns the server for HTTP/2 MITM connections and
+// the base server they are tied to. Shutting the base server down sends
+// GOAWAY to every connection so that idle ones close right away.
+func newMITMHTTP2Server() (*http2.Server, *http.Server, error) {
+	h2 := &http2.Server{IdleTimeout: mitmIdleTimeout}
+	base := &http.Server{}
+	if err := http2.ConfigureServer(base, h2); err != nil {
+		return nil, nil, err
 	}
-	defer req.Body.Close()
+	return h2, base, nil
+}
 
-	req.URL.Scheme = "https"
-	req.URL.Host = host
-	req.RequestURI = ""
+// serveMITMHTTP2 serves an HTTP/2 connection. Every stream is forwarded and
+// recorded as a separate request.
+func (p *ProxyHandler) serveMITMHTTP2(tlsConn *tls.Conn, ci *connInfo) {
+	p.h2.ServeConn(tlsConn, &http2.ServeConnOpts{
+		Context:    withConnInfo(p.conns.ctx, ci),
+		BaseConfig: p.h2Base,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL.Scheme = "https"
+			req.URL.Host = req.Host
+			req.RequestURI = ""
 
-	req.Header.Del("Proxy-Connection")
-	req.Header.Del("Proxy-Authenticate")
-	req.Header.Del("Proxy-Authorization")
+			_, resp, err := p.forward(req, p.transport.RoundTrip)
+			if errors.Is(err, errFaultReset) {
+				panic(http.ErrAbortHandler)
+			}
+			if err != nil {
+				log.Printf("[%s] %v", ci.ID, err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
 
-	resp, err := http.DefaultTransport.RoundTrip(req)
-	if err != nil {
-		log.Printf("Failed to make request to %s: %v", host, err)
-		return
+			removeHopHeaders(resp.Header)
+			for k, vv := range resp.Header {
+				for _, v := range vv {
+					w.Header().Add(k, v)
+				}
+			}
+			w.WriteHeader(resp.StatusCode)
+			if err := copyAndFlush(w, resp.Body); errors.Is(err, errFaultTruncated) {
+				panic(http.ErrAbortHandler)
+			}
+		}),
+	})
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// writeErrorResponse writes a minimal plain-text response that closes the
+// connection. It is used where no http.ResponseWriter is available.
+func writeErrorResponse(w io.Writer, code int, msg string) error {
+	body := msg + "\n"
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
 	}
-	defer resp.Body.Close()
+	return resp.Write(w)
+}
 
-	if err := resp.Write(tlsConn); err != nil {
-		log.Printf("Failed to write response to client: %v", err)
+// ServeTransparent accepts raw TCP connections on l, e.g. redirected there
+// by iptables, and intercepts them without any proxy handshake. The
+// destination of each connection is taken from the TLS SNI or the HTTP Host
+// header. After Shutdown it returns http.ErrServerClosed. Clients cannot be
+// authenticated, so it fails at once while proxy auth is configured.
+func (p *ProxyHandler) ServeTransparent(l net.Listener) error {
+	if p.auth != nil {
+		return errors.New("transparent mode cannot authenticate clients and is unavailable while proxy auth is configured")
+	}
+	if !p.conns.listen(l) {
+		return http.ErrServerClosed
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.conns.isDraining() {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go p.mitmConnection(conn)
 	}
 }
 
+func (p *ProxyHandler) mitmConnection(clientConn net.Conn) {
+	defer clientConn.Close()
+	p.serveTunnel(clientConn, "", "")
+}
+
+// bufferedConn lets the first bytes of a connection be peeked at without
+// losing them for the next reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 type contextReader struct {
 	ctx    context.Context
 	reader io.Reader
@@ -158,6 +468,11 @@ func (r *contextReader) Read(p []byte) (n int, err error) {
 	}
 }
 
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 func isClosedConnError(err error) bool {
 	return strings.Contains(err.Error(), "use of closed network connection") ||
 		strings.Contains(err.Error(), "connection reset by peer")
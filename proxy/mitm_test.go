@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// shortDeadlineConn brings every read deadline set on it forward to
+// shortDeadline from now, so tests do not wait for the real timeouts.
+type shortDeadlineConn struct {
+	net.Conn
+}
+
+const shortDeadline = 200 * time.Millisecond
+
+func (c shortDeadlineConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		t = time.Now().Add(shortDeadline)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c shortDeadlineConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func testCertificate(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTunnelTestProxy returns a handler able to serve MITM tunnels whose
+// requests to upstream are out of scope, so that nothing is recorded.
+func newTunnelTestProxy(t *testing.T, upstream *url.URL) *ProxyHandler {
+	t.Helper()
+	router, err := newUpstreamRouter(UpstreamConfig{}, newHostDialer(TransportConfig{}, &hostMap{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := newUpstreamTransport(Config{}, router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, h2Base, err := newMITMHTTP2Server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ProxyHandler{
+		certManager: &CertManager{certs: map[string]tls.Certificate{"example.test": testCertificate(t, "example.test")}},
+		upstream:    router,
+		transport:   transport,
+		scope:       &scope{},
+		passthrough: newPassthroughList(PassthroughConfig{}),
+		conns:       newConnTracker(),
+		h2:          h2,
+		h2Base:      h2Base,
+		intercept:   newInterceptQueue(),
+		rules:       &ruleSet{},
+		faults:      &faultSet{},
+		mocks:       &mockSet{},
+		scripts:     &scriptSet{},
+	}
+	p.scope.set([]*ScopeRule{{Include: false, Port: urlPort(upstream), Enabled: true}})
+	return p
+}
+
+func TestMITMHTTP2StreamOutlivesTunnelReadDeadline(t *testing.T) {
+	up := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		time.Sleep(3 * shortDeadline)
+		io.WriteString(w, "second")
+	}))
+	defer up.Close()
+	upURL, err := url.Parse(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTunnelTestProxy(t, upURL)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go p.serveTunnel(shortDeadlineConn{server}, "", "")
+
+	tlsConn := tls.Client(client, &tls.Config{
+		ServerName:         "example.test",
+		NextProtos:         []string{http2.NextProtoTLS},
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		t.Fatalf("negotiated %q, want h2", proto)
+	}
+	cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+upURL.Host+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v (got %q)", err, body)
+	}
+	if string(body) != "first second" {
+		t.Fatalf("body = %q, want %q", body, "first second")
+	}
+}
+
+func TestMITMHTTP1SlowUploadOutlivesReadTimeout(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer up.Close()
+	upURL, err := url.Parse(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTunnelTestProxy(t, upURL)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go p.serveTunnel(shortDeadlineConn{server}, "", "")
+
+	go func() {
+		io.WriteString(client, "POST / HTTP/1.1\r\nHost: "+upURL.Host+"\r\nContent-Length: 11\r\n\r\nslow ")
+		time.Sleep(3 * shortDeadline)
+		io.WriteString(client, "upload")
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "slow upload" {
+		t.Fatalf("got %s %q, want 200 %q", resp.Status, body, "slow upload")
+	}
+}
+
+func TestMITMHTTP1HeldRequestReleasedOnClientClose(t *testing.T) {
+	p := newTunnelTestProxy(t, &url.URL{Scheme: "http", Host: "127.0.0.1:1"})
+	p.SetInterceptSettings(InterceptSettings{Enabled: true, TimeoutSeconds: 60})
+
+	client, server := net.Pipe()
+	go p.serveTunnel(server, "", "")
+
+	waitPending := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(p.PendingIntercepts()) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d intercepts pending, want %d", len(p.PendingIntercepts()), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	go io.WriteString(client, "POST / HTTP/1.1\r\nHost: held.test\r\nContent-Length: 4\r\n\r\nbody")
+	waitPending(1)
+	client.Close()
+	waitPending(0)
+}
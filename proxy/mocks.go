@@ -0,0 +1,411 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Sources of a mocked response.
+const (
+	MockSourceRequest = "request"
+	MockSourceFile    = "file"
+	MockSourceInline  = "inline"
+)
+
+// MockRule answers matching requests without contacting the upstream. Empty
+// match fields match anything. Path is a glob such as "/api/users/*" and
+// Query lists parameters that must be present, e.g. "debug&id=42".
+type MockRule struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Method  string `json:"method"`
+	Host    string `json:"host"`
+	Path    string `json:"path"`
+	Query   string `json:"query"`
+	Source  string `json:"source"`
+	Enabled bool   `json:"enabled"`
+
+	// RequestID names a recorded request whose response is replayed. A
+	// response too large for the database is served from its spool file.
+	RequestID string `json:"request_id,omitempty"`
+	// FilePath is served as the body for the file source. It is relative
+	// to the mocks directory and may not leave it.
+	FilePath string `json:"file_path,omitempty"`
+	// StatusCode, Headers and Body describe an inline response. Body is a
+	// text/template executed with the request's Method, Host, Path, Query
+	// and Header. StatusCode and Headers also apply to file responses.
+	StatusCode int               `json:"status_code,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+}
+
+func (r *MockRule) validate() error {
+	switch r.Source {
+	case MockSourceRequest:
+		if r.RequestID == "" {
+			return fmt.Errorf("request_id is required")
+		}
+	case MockSourceFile:
+		if r.FilePath == "" {
+			return fmt.Errorf("file_path is required")
+		}
+		if !filepath.IsLocal(r.FilePath) {
+			return fmt.Errorf("file_path must be relative to the mocks directory")
+		}
+	case MockSourceInline:
+		if _, err := template.New("mock").Parse(r.Body); err != nil {
+			return fmt.Errorf("invalid body template: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown mock source %q", r.Source)
+	}
+	if _, err := path.Match(r.Path, "/"); err != nil {
+		return fmt.Errorf("invalid path pattern: %v", err)
+	}
+	if _, err := url.ParseQuery(r.Query); err != nil {
+		return fmt.Errorf("invalid query: %v", err)
+	}
+	if r.StatusCode != 0 && (r.StatusCode < 100 || r.StatusCode > 999) {
+		return fmt.Errorf("invalid status code %d", r.StatusCode)
+	}
+	return nil
+}
+
+type compiledMock struct {
+	rule  *MockRule
+	query url.Values
+	body  *template.Template
+}
+
+func (m *compiledMock) matches(req *http.Request) bool {
+	r := m.rule
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.Host != "" && !matchHost(r.Host, req.URL.Host) {
+		return false
+	}
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+	query := req.URL.Query()
+	for k, want := range m.query {
+		if !query.Has(k) {
+			return false
+		}
+		if len(want) > 0 && want[0] != "" && query.Get(k) != want[0] {
+			return false
+		}
+	}
+	return true
+}
+
+type mockSet struct {
+	mu    sync.RWMutex
+	mocks []*compiledMock
+}
+
+func (s *mockSet) set(rules []*MockRule) error {
+	var mocks []*compiledMock
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		m := &compiledMock{rule: r}
+		m.query, _ = url.ParseQuery(r.Query)
+		if r.Source == MockSourceInline {
+			tmpl, err := template.New("mock").Parse(r.Body)
+			if err != nil {
+				return fmt.Errorf("mock rule %d: %v", r.ID, err)
+			}
+			m.body = tmpl
+		}
+		mocks = append(mocks, m)
+	}
+
+	s.mu.Lock()
+	s.mocks = mocks
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *mockSet) match(req *http.Request) *compiledMock {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, m := range s.mocks {
+		if m.matches(req) {
+			return m
+		}
+	}
+	return nil
+}
+
+// mockResponder returns a send function answering req from a matching mock
+// rule, or nil when no rule matches.
+func (p *ProxyHandler) mockResponder(req *http.Request) (func(*http.Request) (*http.Response, error), int64) {
+	m := p.mocks.match(req)
+	if m == nil {
+		return nil, 0
+	}
+	return func(req *http.Request) (*http.Response, error) {
+		return p.mockResponse(m, req)
+	}, m.rule.ID
+}
+
+func (p *ProxyHandler) mockResponse(m *compiledMock, req *http.Request) (*http.Response, error) {
+	r := m.rule
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+
+	var body []byte
+	// spooled holds the full stored body when it was too large for the
+	// database.
+	var spooled *os.File
+	switch r.Source {
+	case MockSourceRequest:
+		stored, err := p.store.GetRequest(r.RequestID)
+		if err != nil {
+			return nil, fmt.Errorf("mock rule %d: stored request %s: %v", r.ID, r.RequestID, err)
+		}
+		resp.StatusCode = stored.Response.StatusCode
+		for k, vv := range stored.Response.Headers {
+			resp.Header[k] = vv
+		}
+		if stored.Response.Truncated {
+			if stored.Response.BodyFile == "" {
+				return nil, fmt.Errorf("mock rule %d: stored response of %s is truncated and was not spooled", r.ID, r.RequestID)
+			}
+			f, err := os.Open(stored.Response.BodyFile)
+			if err != nil {
+				return nil, fmt.Errorf("mock rule %d: %v", r.ID, err)
+			}
+			spooled = f
+			break
+		}
+		// Prefer the bytes as sent so Content-Encoding stays valid.
+		body = stored.Response.RawBody
+		if len(body) == 0 {
+			body = stored.Response.Body
+		}
+	case MockSourceFile:
+		name, err := p.mockFilePath(r.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("mock rule %d: %v", r.ID, err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("mock rule %d: %v", r.ID, err)
+		}
+		body = data
+		if ct := mime.TypeByExtension(filepath.Ext(r.FilePath)); ct != "" {
+			resp.Header.Set("Content-Type", ct)
+		} else {
+			resp.Header.Set("Content-Type", http.DetectContentType(data))
+		}
+	case MockSourceInline:
+		var buf bytes.Buffer
+		err := m.body.Execute(&buf, map[string]interface{}{
+			"Method": req.Method,
+			"Host":   req.URL.Host,
+			"Path":   req.URL.Path,
+			"Query":  req.URL.Query(),
+			"Header": req.Header,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("mock rule %d: %v", r.ID, err)
+		}
+		body = buf.Bytes()
+	}
+
+	if r.StatusCode != 0 {
+		resp.StatusCode = r.StatusCode
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	for k, v := range r.Headers {
+		resp.Header.Set(k, v)
+	}
+	resp.Header.Del("Transfer-Encoding")
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+
+	if spooled != nil {
+		info, err := spooled.Stat()
+		if err != nil {
+			spooled.Close()
+			return nil, fmt.Errorf("mock rule %d: %v", r.ID, err)
+		}
+		resp.ContentLength = info.Size()
+		resp.Body = spooled
+	} else {
+		resp.ContentLength = int64(len(body))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	return resp, nil
+}
+
+// mockFilePath resolves name inside the mocks directory, following
+// symlinks, and fails when the result lies outside of it.
+func (p *ProxyHandler) mockFilePath(name string) (string, error) {
+	if p.cfg.Mocks.Dir == "" {
+		return "", fmt.Errorf("file mocks are disabled")
+	}
+	root, err := filepath.EvalSymlinks(p.cfg.Mocks.Dir)
+	if err != nil {
+		return "", err
+	}
+	full, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Clean(name)))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, full); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside the mocks directory", name)
+	}
+	return full, nil
+}
+
+func (p *ProxyHandler) ReloadMockRules() error {
+	rules, err := p.store.GetMockRules()
+	if err != nil {
+		return err
+	}
+	return p.mocks.set(rules)
+}
+
+func (p *ProxyHandler) CreateMockRule(rule *MockRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.CreateMockRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadMockRules()
+}
+
+func (p *ProxyHandler) UpdateMockRule(rule *MockRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.UpdateMockRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadMockRules()
+}
+
+func (p *ProxyHandler) DeleteMockRule(id int64) error {
+	if err := p.store.DeleteMockRule(id); err != nil {
+		return err
+	}
+	return p.ReloadMockRules()
+}
+
+func (s *DBStore) GetMockRules() ([]*MockRule, error) {
+	rows, err := s.db.Query(`
+        SELECT id, name, method, host, path, query, source, enabled,
+               request_id, file_path, status_code, headers, body
+        FROM mock_rules
+        ORDER BY id
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mock rules: %v", err)
+	}
+	defer rows.Close()
+
+	rules := []*MockRule{}
+	for rows.Next() {
+		var r MockRule
+		var headers []byte
+		if err := rows.Scan(
+			&r.ID,
+			&r.Name,
+			&r.Method,
+			&r.Host,
+			&r.Path,
+			&r.Query,
+			&r.Source,
+			&r.Enabled,
+			&r.RequestID,
+			&r.FilePath,
+			&r.StatusCode,
+			&headers,
+			&r.Body,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan mock rule row: %v", err)
+		}
+		if len(headers) > 0 {
+			json.Unmarshal(headers, &r.Headers)
+		}
+		rules = append(rules, &r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return rules, nil
+}
+
+func (s *DBStore) CreateMockRule(r *MockRule) error {
+	headers, err := toJSONB(r.Headers)
+	if err != nil {
+		return err
+	}
+
+	return s.db.QueryRow(`
+        INSERT INTO mock_rules (
+            name, method, host, path, query, source, enabled,
+            request_id, file_path, status_code, headers, body
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        RETURNING id
+    `, r.Name, r.Method, r.Host, r.Path, r.Query, r.Source, r.Enabled,
+		r.RequestID, r.FilePath, r.StatusCode, headers, r.Body).Scan(&r.ID)
+}
+
+func (s *DBStore) UpdateMockRule(r *MockRule) error {
+	headers, err := toJSONB(r.Headers)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`
+        UPDATE mock_rules SET
+            name = $1, method = $2, host = $3, path = $4, query = $5,
+            source = $6, enabled = $7, request_id = $8, file_path = $9,
+            status_code = $10, headers = $11, body = $12
+        WHERE id = $13
+    `, r.Name, r.Method, r.Host, r.Path, r.Query, r.Source, r.Enabled,
+		r.RequestID, r.FilePath, r.StatusCode, headers, r.Body, r.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *DBStore) DeleteMockRule(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM mock_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
@@ -21,6 +21,27 @@ type RequestData struct {
 	Timestamp  time.Time
 	Response   *ResponseData
 	Parsed     ParsedRequest
+	ConnID     string
+	Proto      string
+
+	BodyLength    int64
+	BodyTruncated bool
+	BodyFile      string
+
+	AppliedRules []int64
+	Timing       RequestTiming
+
+	ClientAddr   string
+	ClientTLS    *TLSInfo
+	UpstreamAddr string
+	UpstreamTLS  *TLSInfo
+
+	// User is the authenticated proxy user, empty when auth is off.
+	User string
+	// Fault is set when a fault rule degraded the exchange.
+	Fault *InjectedFault
+	// MockRuleID is the mock rule that answered instead of the upstream.
+	MockRuleID int64
 }
 
 type ResponseData struct {
@@ -28,6 +49,11 @@ type ResponseData struct {
 	StatusCode int
 	Headers    http.Header
 	Body       []byte
+	// RawBody keeps the encoded bytes when Body was decoded for storage.
+	RawBody    []byte
+	BodyLength int64
+	Truncated  bool
+	BodyFile   string
 }
 
 type RequestStore struct {
@@ -82,6 +108,8 @@ type ParsedRequest struct {
 	Cookies    map[string]string `json:"cookies"`
 	PostParams map[string]string `json:"post_params"`
 	RawBody    []byte            `json:"raw_body"`
+	// DecodedBody is RawBody with its Content-Encoding removed.
+	DecodedBody []byte `json:"decoded_body,omitempty"`
 }
 
 type ParsedResponse struct {
@@ -97,3 +125,12 @@ type RequestRecord struct {
 	Response  ParsedResponse
 	Timestamp time.Time
 }
+
+type WebSocketMessage struct {
+	ID        int64     `json:"id"`
+	RequestID string    `json:"request_id"`
+	Direction string    `json:"direction"`
+	Opcode    int       `json:"opcode"`
+	Payload   []byte    `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PassthroughConfig lists hosts whose TLS is never terminated by the proxy,
+// typically apps with certificate pinning.
+type PassthroughConfig struct {
+	// Hosts are globs such as "*.bank.example".
+	Hosts []string
+	// AutoFailures switches a host to passthrough after clients rejected
+	// its minted certificate this many times in a row. Zero disables the
+	// automatic mode.
+	AutoFailures int
+}
+
+// passthroughList tracks configured and automatically learned passthrough
+// hosts.
+type passthroughList struct {
+	mu        sync.Mutex
+	hosts     []string
+	threshold int
+	failures  map[string]int
+	auto      map[string]time.Time
+}
+
+func newPassthroughList(cfg PassthroughConfig) *passthroughList {
+	return &passthroughList{
+		hosts:     cfg.Hosts,
+		threshold: cfg.AutoFailures,
+		failures:  make(map[string]int),
+		auto:      make(map[string]time.Time),
+	}
+}
+
+func (l *passthroughList) matches(host string) bool {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.auto[host]; ok {
+		return true
+	}
+	for _, pattern := range l.hosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeFailed counts a client handshake that failed with err and
+// reports whether the host has just been switched to passthrough. Only
+// certificate rejections count; aborted or timed-out handshakes do not.
+func (l *passthroughList) handshakeFailed(host string, err error) bool {
+	if l.threshold <= 0 || host == "" || !isCertRejection(err) {
+		return false
+	}
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.failures[host]++
+	if l.failures[host] < l.threshold {
+		return false
+	}
+	delete(l.failures, host)
+	l.auto[host] = time.Now()
+	return true
+}
+
+func (l *passthroughList) handshakeSucceeded(host string) {
+	l.mu.Lock()
+	delete(l.failures, strings.ToLower(host))
+	l.mu.Unlock()
+}
+
+// certRejectionAlerts are the alerts a client sends when it refuses the
+// certificate it was shown, e.g. because it pins the real one.
+var certRejectionAlerts = []string{
+	"bad certificate",
+	"unsupported certificate",
+	"revoked certificate",
+	"expired certificate",
+	"unknown certificate",
+	"unknown certificate authority",
+}
+
+func isCertRejection(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return false
+	}
+	msg := strings.TrimPrefix(opErr.Err.Error(), "tls: ")
+	for _, alert := range certRejectionAlerts {
+		if msg == alert {
+			return true
+		}
+	}
+	return false
+}
+
+// errSNIPeeked stops the handshake started by peekSNI.
+var errSNIPeeked = errors.New("SNI peeked")
+
+// peekSNI reads the TLS ClientHello at the start of conn and returns the
+// server name it asks for. The bytes read stay available to conn's next
+// reader.
+func peekSNI(conn *bufferedConn) string {
+	var hello bytes.Buffer
+	var sni string
+	tls.Server(&helloConn{Conn: conn, r: io.TeeReader(conn.r, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = info.ServerName
+			return nil, errSNIPeeked
+		},
+	}).Handshake()
+	conn.r = bufio.NewReader(io.MultiReader(&hello, conn.r))
+	return sni
+}
+
+// helloConn feeds a ClientHello to a TLS server that is never meant to
+// answer; its writes are discarded.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *helloConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// PassthroughHost is an entry of the passthrough list as shown by the API.
+type PassthroughHost struct {
+	Host    string     `json:"host"`
+	Auto    bool       `json:"auto"`
+	AddedAt *time.Time `json:"added_at,omitempty"`
+}
+
+// PassthroughHosts lists configured globs followed by hosts switched to
+// passthrough automatically.
+func (p *ProxyHandler) PassthroughHosts() []PassthroughHost {
+	l := p.passthrough
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]PassthroughHost, 0, len(l.hosts)+len(l.auto))
+	for _, h := range l.hosts {
+		out = append(out, PassthroughHost{Host: h})
+	}
+
+	var auto []PassthroughHost
+	for h, added := range l.auto {
+		added := added
+		auto = append(auto, PassthroughHost{Host: h, Auto: true, AddedAt: &added})
+	}
+	sort.Slice(auto, func(i, j int) bool { return auto[i].Host < auto[j].Host })
+	return append(out, auto...)
+}
+
+// ResetPassthroughHost removes an automatically learned host so that it is
+// intercepted again.
+func (p *ProxyHandler) ResetPassthroughHost(host string) error {
+	l := p.passthrough
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.auto[host]; !ok {
+		return fmt.Errorf("%s is not an automatic passthrough host", host)
+	}
+	delete(l.auto, host)
+	return nil
+}
+
+// passthroughTunnel relays a tunnel without terminating TLS and records
+// connection-level metadata instead of requests.
+func (p *ProxyHandler) passthroughTunnel(conn net.Conn, target string) {
+	started := time.Now()
+	sent, received, err := p.relayTunnel(conn, target)
+	if err != nil {
+		return
+	}
+
+	rec := &ConnectionRecord{
+		ConnID:        newConnInfo().ID,
+		Kind:          "tls-passthrough",
+		Target:        target,
+		ClientAddr:    conn.RemoteAddr().String(),
+		BytesSent:     sent,
+		BytesReceived: received,
+		Started:       started,
+		DurationMs:    time.Since(started).Milliseconds(),
+	}
+	if err := p.store.SaveConnection(rec); err != nil {
+		log.Printf("Error saving connection record for %s: %v", target, err)
+	}
+}
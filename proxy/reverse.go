@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ReverseConfig puts the proxy in front of fixed backends. Requests are
+// routed by the longest matching path prefix.
+type ReverseConfig struct {
+	Routes []ReverseRoute
+}
+
+// ReverseRoute sends requests whose path starts with Prefix to Upstream,
+// e.g. "/api" → "https://api.staging.internal". The prefix matches whole
+// path segments, so "/api" covers "/api/users" but not "/apiv2". The path is
+// kept as is.
+type ReverseRoute struct {
+	Prefix   string
+	Upstream string
+}
+
+type reverseRoute struct {
+	prefix   string
+	upstream *url.URL
+}
+
+type reverseRouter struct {
+	routes []reverseRoute
+}
+
+func newReverseRouter(cfg ReverseConfig) (*reverseRouter, error) {
+	rr := &reverseRouter{}
+	for _, route := range cfg.Routes {
+		u, err := url.Parse(route.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("reverse upstream %q: %v", route.Upstream, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("reverse upstream %q must be an http or https URL", route.Upstream)
+		}
+		prefix := route.Prefix
+		if !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		rr.routes = append(rr.routes, reverseRoute{prefix: prefix, upstream: u})
+	}
+
+	sort.SliceStable(rr.routes, func(i, j int) bool {
+		return len(rr.routes[i].prefix) > len(rr.routes[j].prefix)
+	})
+	return rr, nil
+}
+
+func (rr *reverseRouter) routeFor(path string) *reverseRoute {
+	for i := range rr.routes {
+		prefix := rr.routes[i].prefix
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/' {
+			return &rr.routes[i]
+		}
+	}
+	return nil
+}
+
+// ServeReverse serves reverse-proxy traffic accepted on l until Shutdown,
+// after which it returns http.ErrServerClosed. It is an error to call it
+// without any configured reverse route.
+func (p *ProxyHandler) ServeReverse(l net.Listener) error {
+	if len(p.reverse.routes) == 0 {
+		return errors.New("no reverse routes configured")
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(p.serveReverse)}
+	if !p.conns.addServer(srv) {
+		return http.ErrServerClosed
+	}
+	return srv.Serve(l)
+}
+
+// ReverseTLSConfig returns a TLS config serving certificates minted for the
+// name the client asks for, so the listener can stand in for the backend.
+func (p *ProxyHandler) ReverseTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" {
+				return nil, fmt.Errorf("client sent no SNI")
+			}
+			cert, err := p.certManager.GenerateCert(hello.ServerName)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		},
+	}
+}
+
+func (p *ProxyHandler) serveReverse(w http.ResponseWriter, r *http.Request) {
+	p.conns.begin()
+	defer p.conns.end()
+
+	route := p.reverse.routeFor(r.URL.Path)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	publicScheme := "http"
+	if r.TLS != nil {
+		publicScheme = "https"
+	}
+	publicHost := r.Host
+
+	// Join the escaped forms so that encoded characters such as %2F reach
+	// the upstream unchanged.
+	target := *route.upstream
+	target.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + r.URL.EscapedPath()
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+
+	ci := newConnInfo()
+	ci.ClientAddr = r.RemoteAddr
+	ci.TLS = tlsInfoFromState(r.TLS)
+
+	out, err := http.NewRequestWithContext(withConnInfo(r.Context(), ci), r.Method, target.String(), r.Body)
+	if err != nil {
+		http.Error(w, "Error building upstream request", http.StatusBadRequest)
+		return
+	}
+	for k, vv := range r.Header {
+		out.Header[k] = vv
+	}
+	upgrade := isWebSocketUpgrade(r)
+	removeHopHeaders(out.Header)
+	if upgrade {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+		prepareWebSocketRequest(out)
+	}
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		out.Header.Add("X-Forwarded-For", clientIP)
+	}
+	out.Header.Set("X-Forwarded-Host", publicHost)
+	out.Header.Set("X-Forwarded-Proto", publicScheme)
+	out.ContentLength = r.ContentLength
+	out.Host = route.upstream.Host
+	out.Proto, out.ProtoMajor, out.ProtoMinor = r.Proto, r.ProtoMajor, r.ProtoMinor
+
+	reqData, resp, err := p.forward(out, p.transport.RoundTrip)
+	if errors.Is(err, errFaultReset) {
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		log.Printf("[%s] %v", ci.ID, err)
+		http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	rewriteLocation(resp.Header, route.upstream.Host, publicScheme, publicHost)
+	rewriteCookieDomains(resp.Header, route.upstream.Hostname(), hostOnly(publicHost))
+	p.writeResponse(w, resp, reqData)
+}
+
+// rewriteLocation points redirects to the upstream back at the public name.
+func rewriteLocation(h http.Header, upstreamHost, publicScheme, publicHost string) {
+	loc := h.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil || !strings.EqualFold(u.Host, upstreamHost) {
+		return
+	}
+	u.Scheme = publicScheme
+	u.Host = publicHost
+	h.Set("Location", u.String())
+}
+
+// rewriteCookieDomains replaces the upstream name, or any parent domain of
+// it, in Set-Cookie Domain attributes with the public one.
+func rewriteCookieDomains(h http.Header, upstreamHost, publicHost string) {
+	cookies := h.Values("Set-Cookie")
+	for i, c := range cookies {
+		attrs := strings.Split(c, ";")
+		for j, attr := range attrs {
+			name, value, ok := strings.Cut(strings.TrimSpace(attr), "=")
+			if !ok || !strings.EqualFold(name, "domain") {
+				continue
+			}
+			domain := strings.ToLower(strings.TrimPrefix(value, "."))
+			host := strings.ToLower(upstreamHost)
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				attrs[j] = " Domain=" + publicHost
+			}
+		}
+		cookies[i] = strings.Join(attrs, ";")
+	}
+}
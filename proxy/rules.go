@@ -0,0 +1,470 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Targets a MatchRule can be applied to.
+const (
+	RuleTargetRequestLine    = "request_line"
+	RuleTargetRequestHeader  = "request_header"
+	RuleTargetRequestBody    = "request_body"
+	RuleTargetResponseHeader = "response_header"
+	RuleTargetResponseBody   = "response_body"
+)
+
+// MatchRule rewrites live traffic. Header rules see every header as a
+// "Name: value" line; a line rewritten to an empty string removes the header
+// and an empty Match adds Replace as a new header line. Body rules only see
+// uncompressed text bodies no larger than the capture limit; other bodies,
+// including server-sent event streams, stream through untouched.
+type MatchRule struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Target   string `json:"target"`
+	Match    string `json:"match"`
+	Replace  string `json:"replace"`
+	Regex    bool   `json:"regex"`
+	Enabled  bool   `json:"enabled"`
+	Position int    `json:"position"`
+	// BufferChunked lets a body rule also buffer bodies sent without a
+	// Content-Length. They are skipped by default because they are often
+	// long-lived streams that would be held back until they end.
+	BufferChunked bool `json:"buffer_chunked"`
+}
+
+func (r *MatchRule) validate() error {
+	switch r.Target {
+	case RuleTargetRequestLine, RuleTargetRequestHeader, RuleTargetRequestBody,
+		RuleTargetResponseHeader, RuleTargetResponseBody:
+	default:
+		return fmt.Errorf("unknown rule target %q", r.Target)
+	}
+	if r.Regex {
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	return nil
+}
+
+type compiledRule struct {
+	MatchRule
+	re *regexp.Regexp
+}
+
+// replace applies the rule to s and reports whether anything changed.
+func (r *compiledRule) replace(s string) (string, bool) {
+	var out string
+	if r.re != nil {
+		out = r.re.ReplaceAllString(s, r.Replace)
+	} else if r.Match != "" {
+		out = strings.ReplaceAll(s, r.Match, r.Replace)
+	} else {
+		return s, false
+	}
+	return out, out != s
+}
+
+type ruleSet struct {
+	mu    sync.RWMutex
+	rules []*compiledRule
+}
+
+func (rs *ruleSet) set(rules []*MatchRule) {
+	var compiled []*compiledRule
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		c := &compiledRule{MatchRule: *rule}
+		if rule.Regex {
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				log.Printf("Skipping rule %d: %v", rule.ID, err)
+				continue
+			}
+			c.re = re
+		}
+		compiled = append(compiled, c)
+	}
+
+	rs.mu.Lock()
+	rs.rules = compiled
+	rs.mu.Unlock()
+}
+
+func (rs *ruleSet) forTarget(targets ...string) []*compiledRule {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	var out []*compiledRule
+	for _, r := range rs.rules {
+		for _, t := range targets {
+			if r.Target == t {
+				out = append(out, r)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// applyRequestRules rewrites req with the enabled request rules and returns
+// the IDs of the rules that changed something.
+func (p *ProxyHandler) applyRequestRules(req *http.Request) ([]int64, error) {
+	rules := p.rules.forTarget(RuleTargetRequestLine, RuleTargetRequestHeader, RuleTargetRequestBody)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var fired []int64
+	skipBody := false
+	length := req.ContentLength
+	for _, rule := range rules {
+		switch rule.Target {
+		case RuleTargetRequestLine:
+			line, changed := rule.replace(req.Method + " " + req.URL.String())
+			if !changed {
+				continue
+			}
+			method, rawURL, ok := strings.Cut(line, " ")
+			if !ok {
+				return nil, fmt.Errorf("rule %d produced an invalid request line %q", rule.ID, line)
+			}
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d produced an invalid URL: %v", rule.ID, err)
+			}
+			req.Method = method
+			req.URL = u
+			req.Host = u.Host
+		case RuleTargetRequestHeader:
+			if !rewriteHeader(req.Header, rule) {
+				continue
+			}
+		case RuleTargetRequestBody:
+			if skipBody || !isIdentityEncoded(req.Header) {
+				continue
+			}
+			if length < 0 && !rule.BufferChunked {
+				continue
+			}
+			body, ok, err := p.editableBody(&req.Body, length, req.Header)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read request body: %v", err)
+			}
+			if !ok {
+				skipBody = true
+				continue
+			}
+			length = int64(len(body))
+			out, changed := rule.replace(string(body))
+			if !changed {
+				continue
+			}
+			setRequestBody(req, []byte(out))
+			length = req.ContentLength
+		}
+		fired = append(fired, rule.ID)
+	}
+	return fired, nil
+}
+
+// applyResponseRules rewrites resp with the enabled response rules and
+// returns the IDs of the rules that changed something.
+func (p *ProxyHandler) applyResponseRules(resp *http.Response) ([]int64, error) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil, nil
+	}
+	rules := p.rules.forTarget(RuleTargetResponseHeader, RuleTargetResponseBody)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var fired []int64
+	skipBody := false
+	length := resp.ContentLength
+	for _, rule := range rules {
+		switch rule.Target {
+		case RuleTargetResponseHeader:
+			if !rewriteHeader(resp.Header, rule) {
+				continue
+			}
+		case RuleTargetResponseBody:
+			if skipBody || !isIdentityEncoded(resp.Header) {
+				continue
+			}
+			if length < 0 && !rule.BufferChunked {
+				continue
+			}
+			body, ok, err := p.editableBody(&resp.Body, length, resp.Header)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read response body: %v", err)
+			}
+			if !ok {
+				skipBody = true
+				continue
+			}
+			length = int64(len(body))
+			out, changed := rule.replace(string(body))
+			if !changed {
+				continue
+			}
+			setResponseBody(resp, []byte(out))
+			length = resp.ContentLength
+		}
+		fired = append(fired, rule.ID)
+	}
+	return fired, nil
+}
+
+// rewriteHeader applies rule to every "Name: value" line of h and reports
+// whether the header changed.
+func rewriteHeader(h http.Header, rule *compiledRule) bool {
+	if rule.Match == "" {
+		name, value, ok := strings.Cut(rule.Replace, ":")
+		if !ok {
+			return false
+		}
+		h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return true
+	}
+
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	changed := false
+	for _, k := range keys {
+		for _, v := range h[k] {
+			line, c := rule.replace(k + ": " + v)
+			changed = changed || c
+			lines = append(lines, line)
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	for k := range h {
+		delete(h, k)
+	}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			continue
+		}
+		h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return true
+}
+
+func isIdentityEncoded(h http.Header) bool {
+	enc := h.Get("Content-Encoding")
+	return enc == "" || strings.EqualFold(enc, "identity")
+}
+
+// editableBody reads a body for the body rules. It returns false, leaving
+// the body to stream untouched, when the body is not text or is larger than
+// the capture limit; length is the declared length, -1 if unknown.
+func (p *ProxyHandler) editableBody(body *io.ReadCloser, length int64, h http.Header) ([]byte, bool, error) {
+	if !isTextContent(h) {
+		return nil, false, nil
+	}
+	limit := p.cfg.Capture.MaxBodySize
+	if limit > 0 && length > limit {
+		return nil, false, nil
+	}
+	return readBodyLimited(body, limit)
+}
+
+// isTextContent reports whether h declares a textual body that is not a
+// stream. A body without a Content-Type counts as text.
+func isTextContent(h http.Header) bool {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil || isStreamingMediaType(mediaType) {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "xml"),
+		strings.HasSuffix(mediaType, "javascript"),
+		mediaType == "application/x-www-form-urlencoded",
+		mediaType == "application/graphql":
+		return true
+	}
+	return false
+}
+
+// isStreamingContent reports whether h declares a body that is delivered
+// as a stream of events and should never be buffered.
+func isStreamingContent(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && isStreamingMediaType(mediaType)
+}
+
+// isStreamingMediaType reports whether bodies of mediaType are delivered as
+// a stream of events and should never be buffered.
+func isStreamingMediaType(mediaType string) bool {
+	switch mediaType {
+	case "text/event-stream", "application/x-ndjson", "multipart/x-mixed-replace":
+		return true
+	}
+	return false
+}
+
+// ReloadRules refreshes the active rule set from the database.
+func (p *ProxyHandler) ReloadRules() error {
+	rules, err := p.store.GetMatchRules()
+	if err != nil {
+		return err
+	}
+	p.rules.set(rules)
+	return nil
+}
+
+func (p *ProxyHandler) CreateMatchRule(rule *MatchRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.CreateMatchRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadRules()
+}
+
+func (p *ProxyHandler) UpdateMatchRule(rule *MatchRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.UpdateMatchRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadRules()
+}
+
+func (p *ProxyHandler) DeleteMatchRule(id int64) error {
+	if err := p.store.DeleteMatchRule(id); err != nil {
+		return err
+	}
+	return p.ReloadRules()
+}
+
+// ReorderMatchRules assigns positions following the order of ids.
+func (p *ProxyHandler) ReorderMatchRules(ids []int64) error {
+	if err := p.store.ReorderMatchRules(ids); err != nil {
+		return err
+	}
+	return p.ReloadRules()
+}
+
+func (s *DBStore) GetMatchRules() ([]*MatchRule, error) {
+	rows, err := s.db.Query(`
+        SELECT id, name, target, match, replace, regex, enabled, position, buffer_chunked
+        FROM match_rules
+        ORDER BY position, id
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query match rules: %v", err)
+	}
+	defer rows.Close()
+
+	rules := []*MatchRule{}
+	for rows.Next() {
+		var r MatchRule
+		if err := rows.Scan(&r.ID, &r.Name, &r.Target, &r.Match, &r.Replace, &r.Regex, &r.Enabled, &r.Position, &r.BufferChunked); err != nil {
+			return nil, fmt.Errorf("failed to scan match rule row: %v", err)
+		}
+		rules = append(rules, &r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return rules, nil
+}
+
+func (s *DBStore) CreateMatchRule(r *MatchRule) error {
+	return s.db.QueryRow(`
+        INSERT INTO match_rules (name, target, match, replace, regex, enabled, position, buffer_chunked)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING id
+    `, r.Name, r.Target, r.Match, r.Replace, r.Regex, r.Enabled, r.Position, r.BufferChunked).Scan(&r.ID)
+}
+
+func (s *DBStore) UpdateMatchRule(r *MatchRule) error {
+	res, err := s.db.Exec(`
+        UPDATE match_rules SET
+            name = $1, target = $2, match = $3, replace = $4,
+            regex = $5, enabled = $6, position = $7, buffer_chunked = $8
+        WHERE id = $9
+    `, r.Name, r.Target, r.Match, r.Replace, r.Regex, r.Enabled, r.Position, r.BufferChunked, r.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *DBStore) DeleteMatchRule(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM match_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *DBStore) ReorderMatchRules(ids []int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		if _, err := tx.Exec(`UPDATE match_rules SET position = $1 WHERE id = $2`, i, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *DBStore) UpdateAppliedRules(id string, rules []int64) error {
+	applied, err := toJSONB(rules)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE requests SET applied_rules = $1 WHERE id = $2`, applied, id)
+	return err
+}
+
+// expectOneRow turns an update or delete that matched nothing into
+// sql.ErrNoRows.
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ScopeRule includes or excludes targets from recording, interception and
+// active scanning. Out-of-scope traffic is forwarded untouched: no rules,
+// scripts, interceptors, mocks or faults apply to it. Empty fields match
+// anything.
+type ScopeRule struct {
+	ID         int64  `json:"id"`
+	Include    bool   `json:"include"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Scheme     string `json:"scheme"`
+	PathPrefix string `json:"path_prefix"`
+	Enabled    bool   `json:"enabled"`
+}
+
+func (r *ScopeRule) validate() error {
+	switch r.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("unsupported scheme %q", r.Scheme)
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("invalid port %d", r.Port)
+	}
+	return nil
+}
+
+// matches reports whether the rule covers the target. An empty scheme or
+// path means it is not known yet and only the other fields are compared.
+func (r *ScopeRule) matches(scheme, host string, port int, path string) bool {
+	if r.Host != "" && !matchHost(r.Host, host) {
+		return false
+	}
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+	if r.Scheme != "" && scheme != "" && r.Scheme != scheme {
+		return false
+	}
+	if r.PathPrefix != "" && path != "" && !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+	return true
+}
+
+// scope decides which targets are in scope. A target is in scope when it
+// matches an include rule, or there are no include rules, and matches no
+// exclude rule. With no rules at all everything is in scope.
+type scope struct {
+	mu    sync.RWMutex
+	rules []*ScopeRule
+}
+
+func (s *scope) set(rules []*ScopeRule) {
+	var enabled []*ScopeRule
+	for _, r := range rules {
+		if r.Enabled {
+			enabled = append(enabled, r)
+		}
+	}
+
+	s.mu.Lock()
+	s.rules = enabled
+	s.mu.Unlock()
+}
+
+func (s *scope) check(scheme, host string, port int, path string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	included, hasIncludes := false, false
+	for _, r := range s.rules {
+		if r.Include {
+			hasIncludes = true
+			included = included || r.matches(scheme, host, port, path)
+			continue
+		}
+		// An exclude rule limited to some paths cannot rule out a whole
+		// host before the path is known.
+		if path == "" && r.PathPrefix != "" {
+			continue
+		}
+		if r.matches(scheme, host, port, path) {
+			return false
+		}
+	}
+	return included || !hasIncludes
+}
+
+// allowsURL reports whether a request to u is in scope.
+func (s *scope) allowsURL(u *url.URL) bool {
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return s.check(u.Scheme, u.Hostname(), urlPort(u), path)
+}
+
+// allowsTunnel reports whether a tunnel to target (host:port) may contain
+// in-scope traffic and should therefore be intercepted.
+func (s *scope) allowsTunnel(target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return s.check("", target, 0, "")
+	}
+	port, _ := strconv.Atoi(portStr)
+	return s.check("", host, port, "")
+}
+
+func urlPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// InScope reports whether rawURL is in scope, e.g. before the scanner sends
+// active probes to it.
+func (p *ProxyHandler) InScope(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return p.scope.allowsURL(u)
+}
+
+// ReloadScope refreshes the scope rules from the database.
+func (p *ProxyHandler) ReloadScope() error {
+	rules, err := p.store.GetScopeRules()
+	if err != nil {
+		return err
+	}
+	p.scope.set(rules)
+	return nil
+}
+
+func (p *ProxyHandler) CreateScopeRule(rule *ScopeRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.CreateScopeRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadScope()
+}
+
+func (p *ProxyHandler) UpdateScopeRule(rule *ScopeRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	if err := p.store.UpdateScopeRule(rule); err != nil {
+		return err
+	}
+	return p.ReloadScope()
+}
+
+func (p *ProxyHandler) DeleteScopeRule(id int64) error {
+	if err := p.store.DeleteScopeRule(id); err != nil {
+		return err
+	}
+	return p.ReloadScope()
+}
+
+func (s *DBStore) GetScopeRules() ([]*ScopeRule, error) {
+	rows, err := s.db.Query(`
+        SELECT id, include, host, port, scheme, path_prefix, enabled
+        FROM scope_rules
+        ORDER BY id
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scope rules: %v", err)
+	}
+	defer rows.Close()
+
+	rules := []*ScopeRule{}
+	for rows.Next() {
+		var r ScopeRule
+		if err := rows.Scan(&r.ID, &r.Include, &r.Host, &r.Port, &r.Scheme, &r.PathPrefix, &r.Enabled); err != nil {
+			return nil, fmt.Errorf("failed to scan scope rule row: %v", err)
+		}
+		rules = append(rules, &r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return rules, nil
+}
+
+func (s *DBStore) CreateScopeRule(r *ScopeRule) error {
+	return s.db.QueryRow(`
+        INSERT INTO scope_rules (include, host, port, scheme, path_prefix, enabled)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id
+    `, r.Include, r.Host, r.Port, r.Scheme, r.PathPrefix, r.Enabled).Scan(&r.ID)
+}
+
+func (s *DBStore) UpdateScopeRule(r *ScopeRule) error {
+	res, err := s.db.Exec(`
+        UPDATE scope_rules SET
+            include = $1, host = $2, port = $3, scheme = $4,
+            path_prefix = $5, enabled = $6
+        WHERE id = $7
+    `, r.Include, r.Host, r.Port, r.Scheme, r.PathPrefix, r.Enabled, r.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *DBStore) DeleteScopeRule(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM scope_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
@@ -0,0 +1,593 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// defaultScriptTimeout bounds a script call when the script sets none.
+	defaultScriptTimeout = 100 * time.Millisecond
+	// maxScriptSteps bounds the work of a script call independently of the
+	// clock, e.g. a loop of large allocations that finishes within the
+	// timeout.
+	maxScriptSteps = 10_000_000
+)
+
+// Script is a Starlark program run on traffic whose host matches Host (a
+// glob) and whose path starts with PathPrefix; empty filters match all.
+//
+// A script defines on_request(req), on_response(req, resp) or both. req is
+// a dict with the ParsedRequest fields method, scheme, host, path,
+// get_params, headers, cookies and post_params plus body, the decoded body
+// as a string; resp has code, message, headers and body. Matching messages
+// are buffered so that their body can be passed in, except bodies larger
+// than the capture limit, without a declared length or of event streams,
+// which stream through and are passed as None. A function returns None to
+// leave the message alone or a dict of changes: method, host, path,
+// get_params, headers and body for requests, code, headers and body for
+// responses. A header set to None is removed. The json module is available
+// and print() writes to the proxy log.
+//
+// Each call is cancelled after TimeoutMs or maxScriptSteps. A script that
+// fails while running leaves the message unchanged; its error is stored
+// with the request.
+type Script struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix"`
+	Source     string `json:"source"`
+	TimeoutMs  int    `json:"timeout_ms"`
+	Enabled    bool   `json:"enabled"`
+}
+
+func (s *Script) validate() error {
+	if s.TimeoutMs < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	_, err := compileScript(s)
+	return err
+}
+
+func (s *Script) matches(req *http.Request) bool {
+	if s.Host != "" && !matchHost(s.Host, req.URL.Host) {
+		return false
+	}
+	return s.PathPrefix == "" || strings.HasPrefix(req.URL.Path, s.PathPrefix)
+}
+
+type compiledScript struct {
+	script     *Script
+	timeout    time.Duration
+	onRequest  starlark.Callable
+	onResponse starlark.Callable
+}
+
+var scriptPredeclared = starlark.StringDict{
+	"json": json.Module,
+}
+
+var scriptFileOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+	Recursion:       true,
+}
+
+func compileScript(s *Script) (*compiledScript, error) {
+	cs := &compiledScript{script: s, timeout: defaultScriptTimeout}
+	if s.TimeoutMs > 0 {
+		cs.timeout = time.Duration(s.TimeoutMs) * time.Millisecond
+	}
+
+	name := fmt.Sprintf("script-%d.star", s.ID)
+	var globals starlark.StringDict
+	err := cs.run(func(thread *starlark.Thread) error {
+		var err error
+		globals, err = starlark.ExecFileOptions(scriptFileOptions, thread, name, s.Source, scriptPredeclared)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+
+	var ok bool
+	if fn, found := globals["on_request"]; found {
+		if cs.onRequest, ok = fn.(starlark.Callable); !ok {
+			return nil, fmt.Errorf("on_request is not a function")
+		}
+	}
+	if fn, found := globals["on_response"]; found {
+		if cs.onResponse, ok = fn.(starlark.Callable); !ok {
+			return nil, fmt.Errorf("on_response is not a function")
+		}
+	}
+	if cs.onRequest == nil && cs.onResponse == nil {
+		return nil, fmt.Errorf("script defines neither on_request nor on_response")
+	}
+	return cs, nil
+}
+
+// run executes fn on a fresh thread that is cancelled after the timeout.
+func (cs *compiledScript) run(fn func(*starlark.Thread) error) error {
+	id := cs.script.ID
+	thread := &starlark.Thread{
+		Name: fmt.Sprintf("script %d", id),
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("[script %d] %s", id, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	timer := time.AfterFunc(cs.timeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %s", cs.timeout))
+	})
+	defer timer.Stop()
+
+	err := fn(thread)
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return fmt.Errorf("%s", evalErr.Backtrace())
+	}
+	return err
+}
+
+func (cs *compiledScript) call(fn starlark.Callable, args ...starlark.Value) (*starlark.Dict, error) {
+	var v starlark.Value
+	err := cs.run(func(thread *starlark.Thread) error {
+		var err error
+		v, err = starlark.Call(thread, fn, args, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.Dict:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("%s returned %s, want dict or None", fn.Name(), v.Type())
+	}
+}
+
+type scriptSet struct {
+	mu      sync.RWMutex
+	scripts []*compiledScript
+}
+
+func (s *scriptSet) set(scripts []*Script) error {
+	var compiled []*compiledScript
+	for _, script := range scripts {
+		if !script.Enabled {
+			continue
+		}
+		cs, err := compileScript(script)
+		if err != nil {
+			return fmt.Errorf("script %d: %v", script.ID, err)
+		}
+		compiled = append(compiled, cs)
+	}
+
+	s.mu.Lock()
+	s.scripts = compiled
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *scriptSet) matching(req *http.Request) []*compiledScript {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matched []*compiledScript
+	for _, cs := range s.scripts {
+		if cs.script.matches(req) {
+			matched = append(matched, cs)
+		}
+	}
+	return matched
+}
+
+// runRequestScripts passes req through the on_request function of every
+// matching script, in order.
+func (p *ProxyHandler) runRequestScripts(req *http.Request) {
+	for _, cs := range p.scripts.matching(req) {
+		if cs.onRequest == nil {
+			continue
+		}
+		if err := p.runRequestScript(cs, req); err != nil {
+			p.scriptFailed(req, cs, err)
+		}
+	}
+}
+
+func (p *ProxyHandler) runRequestScript(cs *compiledScript, req *http.Request) error {
+	body, ok, err := p.scriptBody(&req.Body, req.ContentLength, req.Header)
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %v", err)
+	}
+
+	parsed := parseRequest(req)
+	reqDict := starlark.NewDict(10)
+	reqDict.SetKey(starlark.String("method"), starlark.String(parsed.Method))
+	reqDict.SetKey(starlark.String("scheme"), starlark.String(parsed.Scheme))
+	reqDict.SetKey(starlark.String("host"), starlark.String(parsed.Host))
+	reqDict.SetKey(starlark.String("path"), starlark.String(parsed.Path))
+	reqDict.SetKey(starlark.String("get_params"), stringMapDict(parsed.GetParams))
+	reqDict.SetKey(starlark.String("headers"), stringMapDict(parsed.Headers))
+	reqDict.SetKey(starlark.String("cookies"), stringMapDict(parsed.Cookies))
+	reqDict.SetKey(starlark.String("post_params"), stringMapDict(formParams(req.Header, body)))
+	reqDict.SetKey(starlark.String("body"), scriptBodyValue(body, ok))
+
+	changes, err := cs.call(cs.onRequest, reqDict)
+	if err != nil || changes == nil {
+		return err
+	}
+
+	for _, item := range changes.Items() {
+		key, _ := starlark.AsString(item[0])
+		switch key {
+		case "method":
+			method, err := dictString(item[1], key)
+			if err != nil {
+				return err
+			}
+			req.Method = method
+		case "host":
+			host, err := dictString(item[1], key)
+			if err != nil {
+				return err
+			}
+			req.URL.Host = host
+			req.Host = host
+		case "path":
+			path, err := dictString(item[1], key)
+			if err != nil {
+				return err
+			}
+			req.URL.Path = path
+			req.URL.RawPath = ""
+		case "get_params":
+			params, err := dictHeaders(item[1], key)
+			if err != nil {
+				return err
+			}
+			query := url.Values{}
+			for k, v := range params {
+				if v != nil {
+					query.Set(k, *v)
+				}
+			}
+			req.URL.RawQuery = query.Encode()
+		case "headers":
+			headers, err := dictHeaders(item[1], key)
+			if err != nil {
+				return err
+			}
+			applyScriptHeaders(req.Header, headers)
+		case "body":
+			newBody, err := dictString(item[1], key)
+			if err != nil {
+				return err
+			}
+			req.Header.Del("Content-Encoding")
+			setRequestBody(req, []byte(newBody))
+		default:
+			return fmt.Errorf("on_request returned unknown key %q", key)
+		}
+	}
+	return nil
+}
+
+// runResponseScripts passes resp through the on_response function of every
+// matching script, in order.
+func (p *ProxyHandler) runResponseScripts(resp *http.Response) {
+	if resp.Request == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	for _, cs := range p.scripts.matching(resp.Request) {
+		if cs.onResponse == nil {
+			continue
+		}
+		if err := p.runResponseScript(cs, resp); err != nil {
+			p.scriptFailed(resp.Request, cs, err)
+		}
+	}
+}
+
+func (p *ProxyHandler) runResponseScript(cs *compiledScript, resp *http.Response) error {
+	req := resp.Request
+	parsedReq := parseRequest(req)
+	reqDict := starlark.NewDict(6)
+	reqDict.SetKey(starlark.String("method"), starlark.String(parsedReq.Method))
+	reqDict.SetKey(starlark.String("scheme"), starlark.String(parsedReq.Scheme))
+	reqDict.SetKey(starlark.String("host"), starlark.String(parsedReq.Host))
+	reqDict.SetKey(starlark.String("path"), starlark.String(parsedReq.Path))
+	reqDict.SetKey(starlark.String("get_params"), stringMapDict(parsedReq.GetParams))
+	reqDict.SetKey(starlark.String("headers"), stringMapDict(parsedReq.Headers))
+
+	body, ok, err := p.scriptBody(&resp.Body, resp.ContentLength, resp.Header)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	parsed := parseResponse(resp)
+	respDict := starlark.NewDict(4)
+	respDict.SetKey(starlark.String("code"), starlark.MakeInt(parsed.Code))
+	respDict.SetKey(starlark.String("message"), starlark.String(parsed.Message))
+	respDict.SetKey(starlark.String("headers"), stringMapDict(parsed.Headers))
+	respDict.SetKey(starlark.String("body"), scriptBodyValue(body, ok))
+
+	changes, err := cs.call(cs.onResponse, reqDict, respDict)
+	if err != nil || changes == nil {
+		return err
+	}
+
+	for _, item := range changes.Items() {
+		key, _ := starlark.AsString(item[0])
+		switch key {
+		case "code":
+			var code int
+			if err := starlark.AsInt(item[1], &code); err != nil {
+				return fmt.Errorf("code: %v", err)
+			}
+			if code < 100 || code > 999 {
+				return fmt.Errorf("invalid status code %d", code)
+			}
+			resp.StatusCode = code
+			resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+		case "headers":
+			headers, err := dictHeaders(item[1], key)
+			if err != nil {
+				return err
+			}
+			applyScriptHeaders(resp.Header, headers)
+		case "body":
+			newBody, err := dictString(item[1], key)
+			if err != nil {
+				return err
+			}
+			resp.Header.Del("Content-Encoding")
+			setResponseBody(resp, []byte(newBody))
+		default:
+			return fmt.Errorf("on_response returned unknown key %q", key)
+		}
+	}
+	return nil
+}
+
+// scriptBody reads a body for a script, decoded when it is compressed. The
+// body stays readable for the rest of the pipeline. It returns false
+// without reading a body that is larger than the capture limit, has no
+// declared length or is an event stream, so that streams are not held back.
+func (p *ProxyHandler) scriptBody(body *io.ReadCloser, length int64, h http.Header) ([]byte, bool, error) {
+	data, ok, err := p.bufferableBody(body, length, h)
+	if err != nil || !ok || isIdentityEncoded(h) {
+		return data, ok, err
+	}
+	encoding := strings.Join(h.Values("Content-Encoding"), ",")
+	decoded, err := decodeBody(data, encoding, p.cfg.Capture.MaxBodySize)
+	if errors.Is(err, errDecodedTooLarge) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return data, true, nil
+	}
+	return decoded, true, nil
+}
+
+func scriptBodyValue(body []byte, ok bool) starlark.Value {
+	if !ok {
+		return starlark.None
+	}
+	return starlark.String(body)
+}
+
+func (p *ProxyHandler) scriptFailed(req *http.Request, cs *compiledScript, err error) {
+	msg := fmt.Sprintf("script %d (%s): %v", cs.script.ID, cs.script.Name, err)
+	log.Printf("%s %s: %s", req.Method, req.URL, msg)
+	flow := flowInfoFrom(req.Context())
+	flow.ScriptErrors = append(flow.ScriptErrors, msg)
+}
+
+// saveScriptErrors stores the script errors collected so far for a
+// recorded request.
+func (p *ProxyHandler) saveScriptErrors(id string, flow *flowInfo) {
+	for _, msg := range flow.ScriptErrors {
+		reqErr := &RequestError{
+			RequestID: id,
+			Kind:      ErrorKindScript,
+			Message:   msg,
+			Timestamp: time.Now(),
+		}
+		if err := p.store.SaveRequestError(reqErr); err != nil {
+			log.Printf("Failed to save script error for %s: %v", id, err)
+		}
+	}
+	flow.ScriptErrors = nil
+}
+
+func formParams(h http.Header, body []byte) map[string]string {
+	params := make(map[string]string)
+	if !strings.HasPrefix(h.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return params
+	}
+	values, _ := url.ParseQuery(string(body))
+	for k, v := range values {
+		if len(v) > 0 {
+			params[k] = v[0]
+		}
+	}
+	return params
+}
+
+func stringMapDict(m map[string]string) *starlark.Dict {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	d := starlark.NewDict(len(m))
+	for _, k := range keys {
+		d.SetKey(starlark.String(k), starlark.String(m[k]))
+	}
+	return d
+}
+
+func dictString(v starlark.Value, key string) (string, error) {
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, got %s", key, v.Type())
+	}
+	return s, nil
+}
+
+// dictHeaders converts a dict of strings to a map in which None values
+// become nil.
+func dictHeaders(v starlark.Value, key string) (map[string]*string, error) {
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a dict, got %s", key, v.Type())
+	}
+	out := make(map[string]*string, d.Len())
+	for _, item := range d.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%s keys must be strings", key)
+		}
+		if item[1] == starlark.None {
+			out[name] = nil
+			continue
+		}
+		value, ok := starlark.AsString(item[1])
+		if !ok {
+			return nil, fmt.Errorf("%s[%q] must be a string or None", key, name)
+		}
+		out[name] = &value
+	}
+	return out, nil
+}
+
+func applyScriptHeaders(h http.Header, headers map[string]*string) {
+	for name, value := range headers {
+		if value == nil {
+			h.Del(name)
+			continue
+		}
+		h.Set(name, *value)
+	}
+}
+
+func (p *ProxyHandler) ReloadScripts() error {
+	scripts, err := p.store.GetScripts()
+	if err != nil {
+		return err
+	}
+	return p.scripts.set(scripts)
+}
+
+func (p *ProxyHandler) CreateScript(script *Script) error {
+	if err := script.validate(); err != nil {
+		return err
+	}
+	if err := p.store.CreateScript(script); err != nil {
+		return err
+	}
+	return p.ReloadScripts()
+}
+
+func (p *ProxyHandler) UpdateScript(script *Script) error {
+	if err := script.validate(); err != nil {
+		return err
+	}
+	if err := p.store.UpdateScript(script); err != nil {
+		return err
+	}
+	return p.ReloadScripts()
+}
+
+func (p *ProxyHandler) DeleteScript(id int64) error {
+	if err := p.store.DeleteScript(id); err != nil {
+		return err
+	}
+	return p.ReloadScripts()
+}
+
+func (s *DBStore) GetScripts() ([]*Script, error) {
+	rows, err := s.db.Query(`
+        SELECT id, name, host, path_prefix, source, timeout_ms, enabled
+        FROM scripts
+        ORDER BY id
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scripts: %v", err)
+	}
+	defer rows.Close()
+
+	scripts := []*Script{}
+	for rows.Next() {
+		var sc Script
+		if err := rows.Scan(
+			&sc.ID,
+			&sc.Name,
+			&sc.Host,
+			&sc.PathPrefix,
+			&sc.Source,
+			&sc.TimeoutMs,
+			&sc.Enabled,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan script row: %v", err)
+		}
+		scripts = append(scripts, &sc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return scripts, nil
+}
+
+func (s *DBStore) CreateScript(sc *Script) error {
+	return s.db.QueryRow(`
+        INSERT INTO scripts (name, host, path_prefix, source, timeout_ms, enabled)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id
+    `, sc.Name, sc.Host, sc.PathPrefix, sc.Source, sc.TimeoutMs, sc.Enabled).Scan(&sc.ID)
+}
+
+func (s *DBStore) UpdateScript(sc *Script) error {
+	res, err := s.db.Exec(`
+        UPDATE scripts SET
+            name = $1, host = $2, path_prefix = $3, source = $4,
+            timeout_ms = $5, enabled = $6
+        WHERE id = $7
+    `, sc.Name, sc.Host, sc.PathPrefix, sc.Source, sc.TimeoutMs, sc.Enabled, sc.ID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func (s *DBStore) DeleteScript(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM scripts WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
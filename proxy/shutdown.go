@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// shutdownPollInterval is how often Shutdown checks for remaining work.
+	shutdownPollInterval = 50 * time.Millisecond
+	// shutdownFlushTimeout bounds the wait for handlers to record their
+	// flows after their connections were closed at the deadline.
+	shutdownFlushTimeout = 5 * time.Second
+)
+
+// connTracker follows everything a shutdown has to wait for: tunnels and
+// hijacked connections, in-flight handlers, and the listeners and servers
+// the proxy runs itself. A connection is idle while it waits for the next
+// request and can be closed at once when draining starts.
+type connTracker struct {
+	mu        sync.Mutex
+	draining  bool
+	active    int
+	conns     map[net.Conn]bool
+	listeners map[net.Listener]struct{}
+	servers   []*http.Server
+
+	// ctx is the base context of MITM requests. It is cancelled when the
+	// drain deadline passes so that parked requests give up.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newConnTracker() *connTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connTracker{
+		conns:     make(map[net.Conn]bool),
+		listeners: make(map[net.Listener]struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// add tracks conn until remove is called. It returns false when the proxy
+// is shutting down and conn should be closed right away.
+func (t *connTracker) add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.conns[conn] = false
+	t.active++
+	return true
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[conn]; ok {
+		delete(t.conns, conn)
+		t.active--
+	}
+}
+
+// setIdle records whether conn is waiting for its next request. It returns
+// false when conn becomes idle during a shutdown and should be closed.
+func (t *connTracker) setIdle(conn net.Conn, idle bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[conn]; !ok {
+		return true
+	}
+	if idle && t.draining {
+		return false
+	}
+	t.conns[conn] = idle
+	return true
+}
+
+// begin and end bracket a handler that may still write to the store.
+func (t *connTracker) begin() {
+	t.mu.Lock()
+	t.active++
+	t.mu.Unlock()
+}
+
+func (t *connTracker) end() {
+	t.mu.Lock()
+	t.active--
+	t.mu.Unlock()
+}
+
+// listen registers a listener to close on shutdown. It returns false when
+// the proxy is already shutting down.
+func (t *connTracker) listen(l net.Listener) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.listeners[l] = struct{}{}
+	return true
+}
+
+func (t *connTracker) addServer(srv *http.Server) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.servers = append(t.servers, srv)
+	return true
+}
+
+func (t *connTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain stops accepting work, closes idle connections and returns the
+// servers that still need to be shut down.
+func (t *connTracker) drain() []*http.Server {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.draining = true
+	for l := range t.listeners {
+		l.Close()
+	}
+	for conn, idle := range t.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	return t.servers
+}
+
+// closeAll closes every remaining connection and cancels parked requests.
+// It returns the number of connections closed.
+func (t *connTracker) closeAll() int {
+	t.cancel()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	return len(t.conns)
+}
+
+// wait blocks until no work is left or ctx is done.
+func (t *connTracker) wait(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		active := t.active
+		t.mu.Unlock()
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops the SOCKS5, transparent and reverse listeners and drains
+// open tunnels and requests. Idle connections are closed at once; busy ones
+// get until ctx is done and are then cut, after which the handlers are
+// given a short time to record their flows. The store is left open for the
+// caller to close.
+func (p *ProxyHandler) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, srv := range p.conns.drain() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		}()
+	}
+
+	err := p.conns.wait(ctx)
+	if err != nil {
+		log.Printf("Drain deadline reached, closing %d connections", p.conns.closeAll())
+		flushCtx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+		defer cancel()
+		if p.conns.wait(flushCtx) != nil {
+			log.Printf("Handlers still running after %s, giving up", shutdownFlushTimeout)
+		}
+	}
+
+	wg.Wait()
+	p.transport.CloseIdleConnections()
+	return err
+}
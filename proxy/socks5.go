@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	// RFC 1929 username/password subnegotiation.
+	socks5PasswordVersion = 0x01
+	socks5PasswordSuccess = 0x00
+	socks5PasswordFailure = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddrNotSupported    = 0x08
+
+	socks5HandshakeTimeout = 30 * time.Second
+)
+
+// ServeSOCKS5 accepts SOCKS5 clients on l. CONNECT tunnels are intercepted
+// and recorded exactly like CONNECT requests on the HTTP listener. When
+// proxy auth is configured clients must log in with the same credentials
+// (RFC 1929). After Shutdown it returns http.ErrServerClosed.
+func (p *ProxyHandler) ServeSOCKS5(l net.Listener) error {
+	if !p.conns.listen(l) {
+		return http.ErrServerClosed
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.conns.isDraining() {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go p.handleSOCKS5(conn)
+	}
+}
+
+func (p *ProxyHandler) handleSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	br := bufio.NewReader(conn)
+
+	target, user, err := socks5Handshake(br, conn, p.auth)
+	if err != nil {
+		log.Printf("SOCKS5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.serveTunnel(&bufferedConn{Conn: conn, r: br}, target, user)
+}
+
+// socks5Handshake negotiates authentication and reads the CONNECT request,
+// returning the requested host:port and the authenticated user once the
+// client has been told the tunnel is established. With a nil auth no
+// credentials are asked for.
+func socks5Handshake(br *bufio.Reader, w io.Writer, auth *proxyAuth) (string, string, error) {
+	user, err := socks5Authenticate(br, w, auth)
+	if err != nil {
+		return "", "", err
+	}
+	target, err := socks5ReadConnect(br, w)
+	if err != nil {
+		return "", "", err
+	}
+	return target, user, nil
+}
+
+func socks5Authenticate(br *bufio.Reader, w io.Writer, auth *proxyAuth) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNone)
+	if auth != nil {
+		method = socks5AuthPassword
+	}
+	if !containsByte(methods, method) {
+		w.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", fmt.Errorf("no acceptable authentication method")
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if auth == nil {
+		return "", nil
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if version != socks5PasswordVersion {
+		return "", fmt.Errorf("unsupported password auth version %d", version)
+	}
+	name, err := readSOCKS5String(br)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSOCKS5String(br)
+	if err != nil {
+		return "", err
+	}
+	user, ok := auth.check(name, password)
+	if !ok {
+		w.Write([]byte{socks5PasswordVersion, socks5PasswordFailure})
+		return "", fmt.Errorf("invalid credentials for user %q", name)
+	}
+	if _, err := w.Write([]byte{socks5PasswordVersion, socks5PasswordSuccess}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// readSOCKS5String reads a string prefixed with its one-byte length.
+func readSOCKS5String(br *bufio.Reader) (string, error) {
+	size, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func socks5ReadConnect(br *bufio.Reader, w io.Writer) (string, error) {
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", req[0])
+	}
+	if req[1] != socks5CmdConnect {
+		writeSOCKS5Reply(w, socks5ReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if req[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		name, err := readSOCKS5String(br)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		writeSOCKS5Reply(w, socks5ReplyAddrNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", err
+	}
+
+	if err := writeSOCKS5Reply(w, socks5ReplySucceeded); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKS5Reply sends a reply with an unspecified bound address; the
+// tunnel is served by the proxy itself so there is nothing useful to report.
+func writeSOCKS5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func containsByte(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
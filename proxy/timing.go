@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTiming breaks down where the time of a forwarded request went, in
+// milliseconds. Phases skipped because a pooled connection was reused stay
+// zero.
+type RequestTiming struct {
+	DNSMs     float64 `json:"dns_ms"`
+	ConnectMs float64 `json:"connect_ms"`
+	TLSMs     float64 `json:"tls_ms"`
+	TTFBMs    float64 `json:"ttfb_ms"`
+	TotalMs   float64 `json:"total_ms"`
+}
+
+// timingTrace collects RequestTiming through httptrace hooks. The hooks may
+// run on transport goroutines, hence the mutex.
+type timingTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	timing       RequestTiming
+}
+
+func newTimingTrace() *timingTrace {
+	return &timingTrace{start: time.Now()}
+}
+
+func sinceMs(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
+
+func (t *timingTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.timing.DNSMs = sinceMs(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			t.timing.ConnectMs = sinceMs(t.connectStart)
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.timing.TLSMs = sinceMs(t.tlsStart)
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.timing.TTFBMs = sinceMs(t.start)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// finish stamps the total duration and returns the collected timing.
+func (t *timingTrace) finish() RequestTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timing.TotalMs = sinceMs(t.start)
+	return t.timing
+}
+
+func (p *ProxyHandler) saveTiming(id string, t *timingTrace) {
+	if err := p.store.UpdateTiming(id, t.finish()); err != nil {
+		log.Printf("Failed to save timing for %s: %v", id, err)
+	}
+}
+
+func (s *DBStore) UpdateTiming(id string, t RequestTiming) error {
+	_, err := s.db.Exec(`
+        UPDATE requests SET
+            timing_dns_ms = $1,
+            timing_connect_ms = $2,
+            timing_tls_ms = $3,
+            timing_ttfb_ms = $4,
+            timing_total_ms = $5
+        WHERE id = $6
+    `,
+		t.DNSMs,
+		t.ConnectMs,
+		t.TLSMs,
+		t.TTFBMs,
+		t.TotalMs,
+		id,
+	)
+	return err
+}
+
+// HostLatency holds latency percentiles of the recorded requests to a host.
+type HostLatency struct {
+	Host     string  `json:"host"`
+	Count    int64   `json:"count"`
+	TTFBP50  float64 `json:"ttfb_p50_ms"`
+	TTFBP90  float64 `json:"ttfb_p90_ms"`
+	TTFBP99  float64 `json:"ttfb_p99_ms"`
+	TotalP50 float64 `json:"total_p50_ms"`
+	TotalP90 float64 `json:"total_p90_ms"`
+	TotalP99 float64 `json:"total_p99_ms"`
+}
+
+func (s *DBStore) GetHostLatency() ([]*HostLatency, error) {
+	rows, err := s.db.Query(`
+        SELECT host, COUNT(*),
+               percentile_cont(0.5) WITHIN GROUP (ORDER BY timing_ttfb_ms),
+               percentile_cont(0.9) WITHIN GROUP (ORDER BY timing_ttfb_ms),
+               percentile_cont(0.99) WITHIN GROUP (ORDER BY timing_ttfb_ms),
+               percentile_cont(0.5) WITHIN GROUP (ORDER BY timing_total_ms),
+               percentile_cont(0.9) WITHIN GROUP (ORDER BY timing_total_ms),
+               percentile_cont(0.99) WITHIN GROUP (ORDER BY timing_total_ms)
+        FROM requests
+        WHERE timing_total_ms IS NOT NULL
+        GROUP BY host
+        ORDER BY host
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query host latency: %v", err)
+	}
+	defer rows.Close()
+
+	stats := []*HostLatency{}
+	for rows.Next() {
+		var h HostLatency
+		if err := rows.Scan(
+			&h.Host,
+			&h.Count,
+			&h.TTFBP50,
+			&h.TTFBP90,
+			&h.TTFBP99,
+			&h.TotalP50,
+			&h.TotalP90,
+			&h.TotalP99,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan host latency row: %v", err)
+		}
+		stats = append(stats, &h)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig tunes the shared outbound connection pool. Zero values
+// fall back to the defaults of http.DefaultTransport; a zero limit means
+// unlimited.
+type TransportConfig struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+
+	// Resolver is a DNS server (host[:port]) used instead of the system
+	// resolver for outbound connections.
+	Resolver string
+}
+
+// PoolStats is a snapshot of the outbound pool usage.
+type PoolStats struct {
+	Requests   int64           `json:"requests"`
+	InFlight   int64           `json:"in_flight"`
+	Reused     int64           `json:"reused"`
+	Dials      int64           `json:"dials"`
+	DialErrors int64           `json:"dial_errors"`
+	Open       int64           `json:"open"`
+	Hosts      []HostPoolStats `json:"hosts"`
+}
+
+// HostPoolStats counts the connections dialed to one address, which is the
+// upstream proxy when outbound traffic is chained.
+type HostPoolStats struct {
+	Addr  string `json:"addr"`
+	Dials int64  `json:"dials"`
+	Open  int64  `json:"open"`
+}
+
+type poolStats struct {
+	requests   atomic.Int64
+	inFlight   atomic.Int64
+	reused     atomic.Int64
+	dialErrors atomic.Int64
+
+	mu    sync.Mutex
+	hosts map[string]*HostPoolStats
+}
+
+func (s *poolStats) dialed(addr string, delta int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.hosts[addr]
+	if !ok {
+		h = &HostPoolStats{Addr: addr}
+		s.hosts[addr] = h
+	}
+	if delta > 0 {
+		h.Dials++
+	}
+	h.Open += delta
+}
+
+func (s *poolStats) snapshot() PoolStats {
+	stats := PoolStats{
+		Requests:   s.requests.Load(),
+		InFlight:   s.inFlight.Load(),
+		Reused:     s.reused.Load(),
+		DialErrors: s.dialErrors.Load(),
+		Hosts:      []HostPoolStats{},
+	}
+
+	s.mu.Lock()
+	for _, h := range s.hosts {
+		stats.Dials += h.Dials
+		stats.Open += h.Open
+		stats.Hosts = append(stats.Hosts, *h)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(stats.Hosts, func(i, j int) bool {
+		return stats.Hosts[i].Addr < stats.Hosts[j].Addr
+	})
+	return stats
+}
+
+// pooledConn reports its closing to the pool statistics.
+type pooledConn struct {
+	net.Conn
+	once  sync.Once
+	stats *poolStats
+	addr  string
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() { c.stats.dialed(c.addr, -1) })
+	return c.Conn.Close()
+}
+
+type upstreamTLSRoute struct {
+	host      string
+	transport *http.Transport
+}
+
+// upstreamTransport is the single outbound path used for forwarding, MITM
+// and replay. Requests go through a pooled transport whose TLS settings
+// match the target host; every TLS rule gets its own transport because
+// http.Transport has a single TLS client config.
+type upstreamTransport struct {
+	defaultTransport *http.Transport
+	routes           []upstreamTLSRoute
+	upstream         *upstreamRouter
+	stats            *poolStats
+}
+
+func newUpstreamTransport(cfg Config, upstream *upstreamRouter) (*upstreamTransport, error) {
+	u := &upstreamTransport{
+		upstream: upstream,
+		stats:    &poolStats{hosts: make(map[string]*HostPoolStats)},
+	}
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if ctx.Value(mappedTunnelKey{}) != nil {
+			conn, err = upstream.dial(ctx, addr)
+		} else {
+			conn, err = upstream.dialer.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			u.stats.dialErrors.Add(1)
+			return nil, err
+		}
+		u.stats.dialed(addr, 1)
+		return &pooledConn{Conn: conn, stats: u.stats, addr: addr}, nil
+	}
+
+	newTransport := func(rule UpstreamTLSRule) (*http.Transport, error) {
+		tlsConfig, err := rule.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = upstream.Proxy
+		t.DialContext = dial
+		t.TLSClientConfig = tlsConfig
+		// Upstream connections stay on HTTP/1.1 so upgrades and
+		// response framing work the same on every path.
+		t.ForceAttemptHTTP2 = false
+
+		if cfg.Transport.TLSHandshakeTimeout > 0 {
+			t.TLSHandshakeTimeout = cfg.Transport.TLSHandshakeTimeout
+		}
+		if cfg.Transport.IdleConnTimeout > 0 {
+			t.IdleConnTimeout = cfg.Transport.IdleConnTimeout
+		}
+		t.ResponseHeaderTimeout = cfg.Transport.ResponseHeaderTimeout
+		t.MaxIdleConnsPerHost = cfg.Transport.MaxIdleConnsPerHost
+		t.MaxConnsPerHost = cfg.Transport.MaxConnsPerHost
+		return t, nil
+	}
+
+	var err error
+	if u.defaultTransport, err = newTransport(cfg.UpstreamTLS.Default); err != nil {
+		return nil, fmt.Errorf("upstream TLS: %v", err)
+	}
+
+	for _, rule := range cfg.UpstreamTLS.Rules {
+		t, err := newTransport(rule)
+		if err != nil {
+			return nil, fmt.Errorf("upstream TLS rule for %s: %v", rule.Host, err)
+		}
+		u.routes = append(u.routes, upstreamTLSRoute{host: rule.Host, transport: t})
+	}
+
+	return u, nil
+}
+
+func (u *upstreamTransport) transportFor(host string) *http.Transport {
+	for _, route := range u.routes {
+		if matchHost(route.host, host) {
+			return route.transport
+		}
+	}
+	return u.defaultTransport
+}
+
+func (u *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.stats.requests.Add(1)
+	u.stats.inFlight.Add(1)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				u.stats.reused.Add(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req = u.upstream.tunnelMapped(req)
+
+	resp, err := u.transportFor(req.URL.Hostname()).RoundTrip(req)
+	if err != nil || resp.Body == nil || resp.Body == http.NoBody {
+		u.stats.inFlight.Add(-1)
+		return resp, err
+	}
+
+	// The request stays in flight until its body is closed.
+	body := &inFlightBody{ReadCloser: resp.Body, stats: u.stats}
+	if w, ok := resp.Body.(io.Writer); ok {
+		resp.Body = inFlightUpgrade{inFlightBody: body, w: w}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// inFlightBody counts its request as in flight until it is closed.
+type inFlightBody struct {
+	io.ReadCloser
+	once  sync.Once
+	stats *poolStats
+}
+
+func (b *inFlightBody) Close() error {
+	b.once.Do(func() { b.stats.inFlight.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+// inFlightUpgrade is an inFlightBody for a switched-protocols response, whose
+// body is the writable upstream connection.
+type inFlightUpgrade struct {
+	*inFlightBody
+	w io.Writer
+}
+
+func (b inFlightUpgrade) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func (u *upstreamTransport) CloseIdleConnections() {
+	u.defaultTransport.CloseIdleConnections()
+	for _, route := range u.routes {
+		route.transport.CloseIdleConnections()
+	}
+}
+
+// Transport returns the shared outbound round tripper, for callers outside
+// the proxy that should reuse its pool, TLS and upstream settings.
+func (p *ProxyHandler) Transport() http.RoundTripper {
+	return p.transport
+}
+
+// PoolStats reports the usage of the outbound connection pool.
+func (p *ProxyHandler) PoolStats() PoolStats {
+	return p.transport.stats.snapshot()
+}
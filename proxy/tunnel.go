@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relayTunnel connects conn to target without interception and copies
+// bytes in both directions until either side closes. It returns the number
+// of bytes sent by the client and received from the target.
+func (p *ProxyHandler) relayTunnel(conn net.Conn, target string) (sent, received int64, err error) {
+	upstream, err := p.upstream.dial(context.Background(), target)
+	if err != nil {
+		log.Printf("Failed to open tunnel to %s: %v", target, err)
+		return 0, 0, err
+	}
+	defer upstream.Close()
+
+	sent, received = relay(conn, upstream)
+	return sent, received, nil
+}
+
+// relay copies bytes between a and b until one side closes, then closes
+// both. It returns the number of bytes copied from a to b and from b to a.
+func relay(a, b net.Conn) (aToB, bToA int64) {
+	done := make(chan struct{})
+	go func() {
+		bToA, _ = io.Copy(a, b)
+		a.Close()
+		close(done)
+	}()
+	aToB, _ = io.Copy(b, a)
+	b.Close()
+	<-done
+	return aToB, bToA
+}
+
+// isRawPort reports whether target's port is one of the configured raw
+// ports.
+func (p *ProxyHandler) isRawPort(target string) bool {
+	_, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	for _, raw := range p.cfg.Tunnel.RawPorts {
+		if strconv.Itoa(raw) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// httpMethods are the request-line prefixes recognised when sniffing a
+// tunnel. The HTTP/2 preface starts with "PRI ".
+var httpMethods = []string{
+	"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ",
+	"TRACE ", "PATCH ", "PRI ",
+}
+
+// looksLikeHTTP reports whether the buffered start of r could be an HTTP
+// request line. A start too short to tell counts as HTTP.
+func looksLikeHTTP(r *bufio.Reader) bool {
+	buf, _ := r.Peek(r.Buffered())
+	for _, m := range httpMethods {
+		n := min(len(buf), len(m))
+		if string(buf[:n]) == m[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+// rawTunnel relays a tunnel speaking neither TLS nor HTTP and records it
+// as a "tcp" connection, with a capped hexdump of each direction when
+// enabled.
+func (p *ProxyHandler) rawTunnel(conn net.Conn, target string, ci *connInfo) {
+	started := time.Now()
+	upstream, err := p.upstream.dial(context.Background(), target)
+	if err != nil {
+		log.Printf("[%s] Failed to open TCP tunnel to %s: %v", ci.ID, target, err)
+		return
+	}
+	defer upstream.Close()
+
+	limit := p.cfg.Capture.TCPDumpSize
+	client := &dumpConn{Conn: conn, limit: limit}
+	server := &dumpConn{Conn: upstream, limit: limit}
+	sent, received := relay(client, server)
+
+	rec := &ConnectionRecord{
+		ConnID:        ci.ID,
+		Kind:          "tcp",
+		Target:        target,
+		ClientAddr:    ci.ClientAddr,
+		BytesSent:     sent,
+		BytesReceived: received,
+		Started:       started,
+		DurationMs:    time.Since(started).Milliseconds(),
+		ClientDump:    client.dump(),
+		UpstreamDump:  server.dump(),
+	}
+	if err := p.store.SaveConnection(rec); err != nil {
+		log.Printf("Error saving connection record for %s: %v", target, err)
+	}
+}
+
+// dumpConn keeps the first limit bytes read from the connection.
+type dumpConn struct {
+	net.Conn
+	limit int
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *dumpConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.limit > 0 {
+		c.mu.Lock()
+		if room := c.limit - c.buf.Len(); room > 0 {
+			c.buf.Write(b[:min(n, room)])
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *dumpConn) dump() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf.Len() == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(hex.Dump(c.buf.Bytes()), "\n")
+}
+
+// ConnectionRecord describes a tunnel that was relayed without decrypting
+// or parsing its traffic.
+type ConnectionRecord struct {
+	ID            int64     `json:"id"`
+	ConnID        string    `json:"conn_id"`
+	Kind          string    `json:"kind"`
+	Target        string    `json:"target"`
+	ClientAddr    string    `json:"client_addr"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Started       time.Time `json:"started"`
+	DurationMs    int64     `json:"duration_ms"`
+	// ClientDump and UpstreamDump hold hexdumps of the first bytes sent
+	// by each side of a raw TCP tunnel.
+	ClientDump   string `json:"client_dump,omitempty"`
+	UpstreamDump string `json:"upstream_dump,omitempty"`
+}
+
+func (s *DBStore) SaveConnection(c *ConnectionRecord) error {
+	return s.db.QueryRow(`
+        INSERT INTO connections (
+            conn_id, kind, target, client_addr, bytes_sent, bytes_received,
+            started, duration_ms, client_dump, upstream_dump
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        RETURNING id
+    `,
+		c.ConnID,
+		c.Kind,
+		c.Target,
+		c.ClientAddr,
+		c.BytesSent,
+		c.BytesReceived,
+		c.Started,
+		c.DurationMs,
+		c.ClientDump,
+		c.UpstreamDump,
+	).Scan(&c.ID)
+}
+
+func (s *DBStore) GetConnections() ([]*ConnectionRecord, error) {
+	rows, err := s.db.Query(`
+        SELECT id, conn_id, kind, target, client_addr, bytes_sent,
+               bytes_received, started, duration_ms,
+               COALESCE(client_dump, ''), COALESCE(upstream_dump, '')
+        FROM connections
+        ORDER BY started DESC
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query connections: %v", err)
+	}
+	defer rows.Close()
+
+	records := []*ConnectionRecord{}
+	for rows.Next() {
+		var c ConnectionRecord
+		if err := rows.Scan(
+			&c.ID,
+			&c.ConnID,
+			&c.Kind,
+			&c.Target,
+			&c.ClientAddr,
+			&c.BytesSent,
+			&c.BytesReceived,
+			&c.Started,
+			&c.DurationMs,
+			&c.ClientDump,
+			&c.UpstreamDump,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan connection row: %v", err)
+		}
+		records = append(records, &c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return records, nil
+}
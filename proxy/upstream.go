@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+const upstreamDialTimeout = 30 * time.Second
+
+// UpstreamConfig describes the proxy outbound traffic is chained through.
+type UpstreamConfig struct {
+	// Proxy is the default upstream, e.g. "http://user:pass@gw:3128" or
+	// "socks5://gw:1080". Empty means direct connections.
+	Proxy string
+	// Rules override Proxy for matching hosts. The first match wins.
+	Rules []UpstreamRule
+}
+
+// UpstreamRule routes hosts matching a glob through Proxy. The special value
+// "direct" bypasses any upstream proxy.
+type UpstreamRule struct {
+	Host  string
+	Proxy string
+}
+
+type upstreamRoute struct {
+	host  string
+	proxy *url.URL
+}
+
+// upstreamRouter picks the upstream proxy for an outbound request. Its Proxy
+// method plugs into http.Transport, which handles HTTP CONNECT, plain HTTP
+// proxying and SOCKS5 including credentials given in the URL.
+type upstreamRouter struct {
+	defaultProxy *url.URL
+	routes       []upstreamRoute
+	dialer       *hostDialer
+}
+
+func newUpstreamRouter(cfg UpstreamConfig, dialer *hostDialer) (*upstreamRouter, error) {
+	u := &upstreamRouter{dialer: dialer}
+
+	var err error
+	if u.defaultProxy, err = parseUpstreamURL(cfg.Proxy); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range cfg.Rules {
+		proxyURL, err := parseUpstreamURL(rule.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("upstream rule for %s: %v", rule.Host, err)
+		}
+		u.routes = append(u.routes, upstreamRoute{host: rule.Host, proxy: proxyURL})
+	}
+
+	return u, nil
+}
+
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	if raw == "" || raw == "direct" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %v", raw, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream proxy %q has no host", raw)
+	}
+	return u, nil
+}
+
+// Proxy returns the upstream proxy URL for req, or nil for a direct
+// connection. Requests marked by tunnelMapped return nil as well; their
+// connection is opened through the proxy by dial.
+func (u *upstreamRouter) Proxy(req *http.Request) (*url.URL, error) {
+	if req.Context().Value(mappedTunnelKey{}) != nil {
+		return nil, nil
+	}
+	return u.proxyFor(req.URL.Host), nil
+}
+
+type mappedTunnelKey struct{}
+
+// tunnelMapped marks req for a tunnel to its mapped address when it is both
+// host mapped and chained through an upstream proxy. http.Transport would
+// otherwise send the original name to the proxy and skip the mapping.
+func (u *upstreamRouter) tunnelMapped(req *http.Request) *http.Request {
+	addr := canonicalAddr(req.URL)
+	if u.proxyFor(addr) == nil || !u.dialer.hosts.mapped(addr) {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), mappedTunnelKey{}, true))
+}
+
+// canonicalAddr returns the host:port of u, using the default port of its
+// scheme when it has none.
+func canonicalAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (u *upstreamRouter) proxyFor(host string) *url.URL {
+	for _, route := range u.routes {
+		if matchHost(route.host, host) {
+			return route.proxy
+		}
+	}
+	return u.defaultProxy
+}
+
+// dial opens a raw TCP connection to addr, going through the upstream proxy
+// selected for it. It is used for tunnels that are relayed rather than
+// handled by http.Transport.
+func (u *upstreamRouter) dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := u.dialer
+
+	proxyURL := u.proxyFor(addr)
+	if proxyURL == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	// The upstream proxy connects on our behalf, so it is the one asked
+	// for the mapped address.
+	addr = d.hosts.rewrite(addr)
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *xproxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &xproxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		dialer, err := xproxy.SOCKS5("tcp", proxyHostPort(proxyURL), auth, d)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(xproxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	default:
+		return dialHTTPConnect(ctx, d, proxyURL, addr)
+	}
+}
+
+// dialHTTPConnect opens a tunnel to addr through an HTTP(S) proxy using the
+// CONNECT method.
+func dialHTTPConnect(ctx context.Context, d *hostDialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", proxyHostPort(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+func proxyHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
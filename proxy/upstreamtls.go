@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// UpstreamTLSConfig controls how the proxy verifies upstream servers and
+// which client certificates it presents to them.
+type UpstreamTLSConfig struct {
+	// Default applies to hosts without a matching rule. Its Host is ignored.
+	Default UpstreamTLSRule
+	// Rules override Default for matching hosts. The first match wins.
+	Rules []UpstreamTLSRule
+}
+
+// UpstreamTLSRule holds the TLS settings for hosts matching a glob.
+type UpstreamTLSRule struct {
+	Host string `json:"host"`
+	// Verify enables certificate chain and hostname verification.
+	Verify bool `json:"verify"`
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string `json:"ca_file"`
+	// MinVersion is the lowest accepted version: "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `json:"min_version"`
+	// ClientCert and ClientKey are PEM files of the client certificate
+	// presented to servers that ask for one.
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+}
+
+// LoadUpstreamTLSRules reads a JSON array of UpstreamTLSRule from path.
+func LoadUpstreamTLSRules(path string) ([]UpstreamTLSRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []UpstreamTLSRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid upstream TLS rules in %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (r UpstreamTLSRule) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: !r.Verify}
+
+	if r.MinVersion != "" {
+		v, ok := tlsVersions[r.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", r.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if r.CAFile != "" {
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", r.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if r.ClientCert != "" || r.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(r.ClientCert, r.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Kinds of RequestError.
+const (
+	ErrorKindTLSVerification = "tls_verification"
+	ErrorKindTLSHandshake    = "tls_handshake"
+	ErrorKindUpstream        = "upstream"
+	ErrorKindFault           = "fault"
+	ErrorKindScript          = "script"
+)
+
+// RequestError records why a recorded request did not get a response.
+type RequestError struct {
+	ID        int64     `json:"id"`
+	RequestID string    `json:"request_id"`
+	Kind      string    `json:"kind"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// upstreamErrorKind classifies an error returned while sending a request.
+func upstreamErrorKind(err error) string {
+	if errors.Is(err, errFaultReset) {
+		return ErrorKindFault
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &verifyErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorKindTLSVerification
+	}
+
+	var alert tls.AlertError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &alert) || errors.As(err, &recordErr) {
+		return ErrorKindTLSHandshake
+	}
+	return ErrorKindUpstream
+}
+
+func (s *DBStore) SaveRequestError(e *RequestError) error {
+	return s.db.QueryRow(`
+        INSERT INTO request_errors (request_id, kind, message, timestamp)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id
+    `,
+		e.RequestID,
+		e.Kind,
+		e.Message,
+		e.Timestamp,
+	).Scan(&e.ID)
+}
+
+func (s *DBStore) GetRequestErrors(requestID string) ([]*RequestError, error) {
+	rows, err := s.db.Query(`
+        SELECT id, request_id, kind, message, timestamp
+        FROM request_errors
+        WHERE request_id = $1
+        ORDER BY id
+    `, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query request errors: %v", err)
+	}
+	defer rows.Close()
+
+	errs := []*RequestError{}
+	for rows.Next() {
+		var e RequestError
+		if err := rows.Scan(
+			&e.ID,
+			&e.RequestID,
+			&e.Kind,
+			&e.Message,
+			&e.Timestamp,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan request error row: %v", err)
+		}
+		errs = append(errs, &e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return errs, nil
+}
@@ -0,0 +1,448 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpClose        = 0x8
+
+	// maxWSRecordedPayload caps how much of a single message is stored.
+	// Frames are always relayed in full.
+	maxWSRecordedPayload = 1 << 20
+	// maxWSInterceptedPayload caps the messages buffered for interceptors.
+	maxWSInterceptedPayload = 16 << 20
+	// wsCloseTimeout is how long the peer of a relayed Close frame gets to
+	// answer with its own Close before the connection is torn down.
+	wsCloseTimeout = 5 * time.Second
+)
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareWebSocketRequest removes extension negotiation from the handshake so
+// that frames travel uncompressed and can be recorded as readable messages.
+func prepareWebSocketRequest(r *http.Request) {
+	r.Header.Del("Sec-WebSocket-Extensions")
+}
+
+// relayUpgrade completes a 101 Switching Protocols handshake with the client
+// and relays the upgraded connection in both directions. WebSocket frames are
+// parsed on the fly and, for recorded flows, every message is persisted
+// against the handshake request.
+func (p *ProxyHandler) relayUpgrade(clientConn net.Conn, clientReader *bufio.Reader, resp *http.Response, reqData *RequestData) {
+	var reqID string
+	if reqData != nil {
+		reqID = reqData.ID
+	}
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("Upgrade response body for %s is not writable", resp.Request.URL)
+		return
+	}
+	defer upstream.Close()
+
+	handshake := *resp
+	handshake.Body = nil
+	if err := handshake.Write(clientConn); err != nil {
+		log.Printf("Failed to write upgrade response to client: %v", err)
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+
+	intercepted := p.interceptors.hasWebSocket()
+	isWS := strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") &&
+		(reqID != "" || intercepted)
+	upstreamReader := bufio.NewReader(upstream)
+
+	// Each pump reports whether it stopped after relaying a Close frame.
+	done := make(chan bool, 2)
+	pump := func(dst io.Writer, src *bufio.Reader, direction string) {
+		var err error
+		defer func() { done <- isWS && err == nil }()
+		switch {
+		case isWS && intercepted:
+			err = p.pumpWebSocketMessages(dst, src, reqID, direction)
+		case isWS:
+			err = p.pumpWebSocket(dst, src, reqID, direction)
+		default:
+			_, err = io.Copy(dst, src)
+		}
+		if err != nil && err != io.EOF && !isClosedConnError(err) {
+			log.Printf("WebSocket relay (%s) for %s stopped: %v", direction, reqID, err)
+		}
+	}
+
+	go pump(upstream, clientReader, "client")
+	go pump(clientConn, upstreamReader, "server")
+
+	remaining := 1
+	if <-done {
+		timer := time.NewTimer(wsCloseTimeout)
+		select {
+		case <-done:
+			remaining = 0
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	clientConn.Close()
+	upstream.Close()
+	for ; remaining > 0; remaining-- {
+		<-done
+	}
+}
+
+// pumpWebSocket copies frames from src to dst unchanged while reassembling
+// fragmented messages for storage. It returns nil once it has relayed a
+// Close frame.
+func (p *ProxyHandler) pumpWebSocket(dst io.Writer, src *bufio.Reader, reqID, direction string) error {
+	var (
+		msgOpcode  byte
+		msgPayload []byte
+		inMessage  bool
+	)
+
+	for {
+		fin, opcode, payload, err := copyWSFrame(dst, src)
+		if err != nil {
+			return err
+		}
+
+		if opcode >= wsOpClose {
+			// Control frames may be interleaved with fragments of a data message.
+			p.saveWebSocketMessage(reqID, direction, opcode, payload)
+			if opcode == wsOpClose {
+				return nil
+			}
+			continue
+		}
+
+		if opcode != wsOpContinuation {
+			msgOpcode = opcode
+			msgPayload = nil
+			inMessage = true
+		}
+		if !inMessage {
+			continue
+		}
+		msgPayload = appendCapped(msgPayload, payload, maxWSRecordedPayload)
+
+		if fin {
+			p.saveWebSocketMessage(reqID, direction, msgOpcode, msgPayload)
+			inMessage = false
+		}
+	}
+}
+
+// pumpWebSocketMessages reassembles every data message, runs it through the
+// interceptors and sends what they return as a single frame. Control frames
+// are passed on as they arrive. It returns nil once it has relayed a Close
+// frame.
+func (p *ProxyHandler) pumpWebSocketMessages(dst io.Writer, src *bufio.Reader, reqID, direction string) error {
+	mask := direction == "client"
+	var (
+		msgOpcode  byte
+		msgPayload []byte
+		inMessage  bool
+	)
+
+	for {
+		fin, opcode, payload, err := readWSFrame(src, maxWSInterceptedPayload)
+		if err != nil {
+			return err
+		}
+
+		if opcode >= wsOpClose {
+			if reqID != "" {
+				p.saveWebSocketMessage(reqID, direction, opcode, payload)
+			}
+			if err := writeWSFrame(dst, opcode, payload, mask); err != nil {
+				return err
+			}
+			if opcode == wsOpClose {
+				return nil
+			}
+			continue
+		}
+
+		if opcode != wsOpContinuation {
+			msgOpcode = opcode
+			msgPayload = nil
+			inMessage = true
+		}
+		if !inMessage {
+			continue
+		}
+		if len(msgPayload)+len(payload) > maxWSInterceptedPayload {
+			return fmt.Errorf("WebSocket message larger than %d bytes", maxWSInterceptedPayload)
+		}
+		msgPayload = append(msgPayload, payload...)
+		if !fin {
+			continue
+		}
+		inMessage = false
+
+		msg := &WebSocketMessage{
+			RequestID: reqID,
+			Direction: direction,
+			Opcode:    int(msgOpcode),
+			Payload:   msgPayload,
+			Timestamp: time.Now(),
+		}
+		if err := p.interceptors.webSocketMessage(msg); err == ErrDrop {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("interceptor: %w", err)
+		}
+		if reqID != "" {
+			p.saveWebSocketMessage(reqID, direction, msgOpcode, appendCapped(nil, msg.Payload, maxWSRecordedPayload))
+		}
+		if err := writeWSFrame(dst, msgOpcode, msg.Payload, mask); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *ProxyHandler) saveWebSocketMessage(reqID, direction string, opcode byte, payload []byte) {
+	msg := &WebSocketMessage{
+		RequestID: reqID,
+		Direction: direction,
+		Opcode:    int(opcode),
+		Payload:   payload,
+		Timestamp: time.Now(),
+	}
+	if err := p.store.SaveWebSocketMessage(msg); err != nil {
+		log.Printf("Error saving WebSocket message for %s: %v", reqID, err)
+	}
+}
+
+// copyWSFrame reads a single frame from src, writes it verbatim to dst and
+// returns its unmasked payload, truncated to maxWSRecordedPayload.
+func copyWSFrame(dst io.Writer, src *bufio.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	h, err := readWSFrameHeader(src)
+	if err != nil {
+		return
+	}
+	if _, err = dst.Write(h.raw); err != nil {
+		return
+	}
+
+	rec := &wsPayloadRecorder{mask: h.maskKey, limit: maxWSRecordedPayload}
+	n, err := io.CopyN(io.MultiWriter(dst, rec), src, int64(h.length))
+	if err == nil && uint64(n) != h.length {
+		err = fmt.Errorf("short WebSocket frame")
+	}
+	return h.fin, h.opcode, rec.buf, err
+}
+
+// readWSFrame reads a single frame of at most limit payload bytes and
+// returns its unmasked payload.
+func readWSFrame(src *bufio.Reader, limit int) (fin bool, opcode byte, payload []byte, err error) {
+	h, err := readWSFrameHeader(src)
+	if err != nil {
+		return
+	}
+	if h.length > uint64(limit) {
+		return false, 0, nil, fmt.Errorf("WebSocket frame larger than %d bytes", limit)
+	}
+
+	payload = make([]byte, h.length)
+	if _, err = io.ReadFull(src, payload); err != nil {
+		return
+	}
+	if h.maskKey != nil {
+		for i := range payload {
+			payload[i] ^= h.maskKey[i%4]
+		}
+	}
+	return h.fin, h.opcode, payload, nil
+}
+
+type wsFrameHeader struct {
+	raw     []byte
+	fin     bool
+	opcode  byte
+	length  uint64
+	maskKey []byte
+}
+
+func readWSFrameHeader(src *bufio.Reader) (*wsFrameHeader, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, err
+	}
+	h := &wsFrameHeader{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0f,
+		length: uint64(header[1] & 0x7f),
+	}
+	masked := header[1]&0x80 != 0
+
+	switch h.length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(src, ext); err != nil {
+			return nil, err
+		}
+		header = append(header, ext...)
+		h.length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(src, ext); err != nil {
+			return nil, err
+		}
+		header = append(header, ext...)
+		h.length = binary.BigEndian.Uint64(ext)
+	}
+
+	if masked {
+		h.maskKey = make([]byte, 4)
+		if _, err := io.ReadFull(src, h.maskKey); err != nil {
+			return nil, err
+		}
+		header = append(header, h.maskKey...)
+	}
+	h.raw = header
+	return h, nil
+}
+
+// writeWSFrame writes payload as a single final frame, masked with a fresh
+// key when sent by the client side.
+func writeWSFrame(dst io.Writer, opcode byte, payload []byte, mask bool) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	if mask {
+		header[1] |= 0x80
+		key := make([]byte, 4)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		header = append(header, key...)
+		masked := make([]byte, len(payload))
+		for i, c := range payload {
+			masked[i] = c ^ key[i%4]
+		}
+		payload = masked
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	_, err := dst.Write(payload)
+	return err
+}
+
+// wsPayloadRecorder unmasks and keeps the beginning of a frame payload.
+type wsPayloadRecorder struct {
+	mask  []byte
+	limit int
+	pos   int
+	buf   []byte
+}
+
+func (r *wsPayloadRecorder) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if len(r.buf) >= r.limit {
+			break
+		}
+		if r.mask != nil {
+			c ^= r.mask[r.pos%4]
+		}
+		r.buf = append(r.buf, c)
+		r.pos++
+	}
+	return len(b), nil
+}
+
+func appendCapped(dst, src []byte, limit int) []byte {
+	if room := limit - len(dst); room < len(src) {
+		if room <= 0 {
+			return dst
+		}
+		src = src[:room]
+	}
+	return append(dst, src...)
+}
+
+func (s *DBStore) SaveWebSocketMessage(msg *WebSocketMessage) error {
+	_, err := s.db.Exec(`
+        INSERT INTO ws_messages (request_id, direction, opcode, payload, timestamp)
+        VALUES ($1, $2, $3, $4, $5)
+    `,
+		msg.RequestID,
+		msg.Direction,
+		msg.Opcode,
+		msg.Payload,
+		msg.Timestamp,
+	)
+	return err
+}
+
+func (s *DBStore) GetWebSocketMessages(requestID string) ([]*WebSocketMessage, error) {
+	rows, err := s.db.Query(`
+        SELECT id, request_id, direction, opcode, payload, timestamp
+        FROM ws_messages
+        WHERE request_id = $1
+        ORDER BY id
+    `, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ws messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := []*WebSocketMessage{}
+	for rows.Next() {
+		var msg WebSocketMessage
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.RequestID,
+			&msg.Direction,
+			&msg.Opcode,
+			&msg.Payload,
+			&msg.Timestamp,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan ws message row: %v", err)
+		}
+		messages = append(messages, &msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+	return messages, nil
+}